@@ -1,11 +1,51 @@
 package tftp
 
+import "time"
+
+const (
+	DEFAULT_TIMEOUT         = 2 * time.Second
+	DEFAULT_MAX_RETRIES     = 5
+	MAX_RETRANSMIT_INTERVAL = 60 * time.Second
+)
+
+const (
+	BLOCK_SIZE      = 512
+	MIN_BLOCK_SIZE  = 8
+	MAX_BLOCK_SIZE  = 65464
+	MAX_WINDOW_SIZE = 65535
+	OPCODE_RRQ      = 1
+	OPCODE_WRQ      = 2
+	OPCODE_DATA     = 3
+	OPCODE_ACK      = 4
+	OPCODE_ERROR    = 5
+	OPCODE_OACK     = 6
+)
+
+// TFTP transfer modes (RFC 1350).
+const (
+	MODE_OCTET    = "octet"
+	MODE_NETASCII = "netascii"
+)
+
+// TFTP error codes (RFC 1350, RFC 2347).
+const (
+	ERROR_UNDEFINED          = 0
+	ERROR_FILE_NOT_FOUND     = 1
+	ERROR_ACCESS_VIOLATION   = 2
+	ERROR_DISK_FULL          = 3
+	ERROR_ILLEGAL_OPERATION  = 4
+	ERROR_UNKNOWN_TID        = 5
+	ERROR_FILE_EXISTS        = 6
+	ERROR_NO_SUCH_USER       = 7
+	ERROR_OPTION_NEGOTIATION = 8
+)
+
 const (
-	BLOCK_SIZE   = 512
-	OPCODE_RRQ   = 1
-	OPCODE_DATA  = 3
-	OPCODE_ACK   = 4
-	OPCODE_ERROR = 5
+	tftpOptionBlockSize    = "blksize"
+	tftpOptionTransferSize = "tsize"
+	tftpOptionTimeout      = "timeout"
+	tftpOptionWindowSize   = "windowsize"
+	tftpOptionRollover     = "rollover"
 )
 
 const (
@@ -13,21 +53,43 @@ const (
 	GetTypeHTTP
 )
 
+const (
+	RolloverToZero RolloverMode = iota
+	RolloverToOne
+)
+
+const (
+	// BootPlacementBoth fills the BOOTP sname/file header fields and options 66/67.
+	BootPlacementBoth BootPlacement = iota
+	// BootPlacementHeader uses only the header fields, for ROMs that ignore options.
+	BootPlacementHeader
+	// BootPlacementOptions uses only options 66/67, leaving sname/file free for overload.
+	BootPlacementOptions
+)
+
+const (
+	// dhcpMinMessageSize is the reply size every client must accept (RFC 2131 §2):
+	// 576 bytes of IP datagram less the IP and UDP headers.
+	dhcpMinMessageSize = 576 - 28
+	dhcpSnameLen       = 64
+	dhcpFileLen        = 128
+)
+
 const (
 	dhcpOpRequest = 1
 	dhcpOpReply   = 2
 
-	dhcpOptionMessageType   = 53
-	dhcpOptionServerID      = 54
-	dhcpOptionRequestedIP   = 50
-	dhcpOptionLeaseTime     = 51
-	dhcpOptionSubnetMask    = 1
-	dhcpOptionRouter        = 3
-	dhcpOptionDNSServer     = 6
-	dhcpOptionDomainName    = 15
-	dhcpOptionBootFileName  = 67
-	dhcpOptionTFTPServer    = 66
-	dhcpOptionEnd           = 255
+	dhcpOptionMessageType  = 53
+	dhcpOptionServerID     = 54
+	dhcpOptionRequestedIP  = 50
+	dhcpOptionLeaseTime    = 51
+	dhcpOptionSubnetMask   = 1
+	dhcpOptionRouter       = 3
+	dhcpOptionDNSServer    = 6
+	dhcpOptionDomainName   = 15
+	dhcpOptionBootFileName = 67
+	dhcpOptionTFTPServer   = 66
+	dhcpOptionEnd          = 255
 
 	dhcpMessageDiscover = 1
 	dhcpMessageOffer    = 2
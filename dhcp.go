@@ -3,12 +3,15 @@ package tftp
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/iana"
 )
 
 // DHCPRequest represents the parsed DHCP client request for allocator decisions.
@@ -19,6 +22,37 @@ type DHCPRequest struct {
 	RequestedIP net.IP
 	CurrentIP   net.IP
 	GatewayIP   net.IP
+	// ServerID is option 54: set on REQUESTs answering an offer (SELECTING state), empty
+	// for INIT-REBOOT, RENEWING and REBINDING.
+	ServerID net.IP
+
+	// PXE identification: option 60 vendor class, option 93 architectures, option 94
+	// interface and option 97 machine UUID (canonical lowercase form).
+	VendorClass     string
+	ClientArch      []iana.Arch
+	ClientInterface *PXEInterface
+	ClientUUID      string
+
+	// UserClass is option 77; iPXE sends "iPXE". IPXEFeatures holds the sub-options of
+	// iPXE's option 175, keyed by code (e.g. 19 for HTTP support).
+	UserClass    []string
+	IPXEFeatures map[uint8][]byte
+
+	// RelayInfo is option 82 as added by a relay agent, nil when absent. It is echoed in
+	// every reply (RFC 3046).
+	RelayInfo *DHCPRelayInfo
+
+	// PreviousLease is the client's last lease from Options.DHCPLeaseStore, if any.
+	PreviousLease *DHCPLease
+}
+
+// DHCPRelayInfo holds the relay agent information sub-options (RFC 3046), e.g. to allocate
+// per switch port.
+type DHCPRelayInfo struct {
+	CircuitID []byte // sub-option 1, typically the port/VLAN the request arrived on
+	RemoteID  []byte // sub-option 2, typically the relay or switch itself
+	// SubOptions has every sub-option by code, including the two above.
+	SubOptions map[uint8][]byte
 }
 
 // DHCPOffer describes the parameters the server will offer/ack to a client.
@@ -31,13 +65,40 @@ type DHCPOffer struct {
 	BootFile   string
 	NextServer net.IP
 	LeaseTime  time.Duration
+
+	// ServerName is the TFTP server name for sname/option 66 (default NextServer as text).
+	// NextServer itself always goes into siaddr.
+	ServerName string
+	// BootPlacement picks header fields, options 66/67 or both. A name too long for its
+	// header field is sent as an option regardless.
+	BootPlacement BootPlacement
+
+	// Options carries any further options by code, encoded as on the wire. The Set*
+	// helpers fill it for common ones; entries here override the fields above.
+	Options dhcpv4.Options
 }
 
+// ErrDHCPNak is returned (directly or wrapped) by a DHCPAllocator to refuse a REQUEST, e.g.
+// for an address on the wrong subnet or one that belongs to someone else. The server then
+// answers with DHCPNAK so the client restarts from DISCOVER instead of retrying.
+var ErrDHCPNak = errors.New("dhcp request refused")
+
 // DHCPAllocator decides what to offer to a DHCP client.
 type DHCPAllocator interface {
 	Offer(req *DHCPRequest) (*DHCPOffer, error)
 }
 
+// DHCPReleaser is an optional DHCPAllocator extension notified of DHCPRELEASE.
+type DHCPReleaser interface {
+	Release(req *DHCPRequest) error
+}
+
+// DHCPDecliner is an optional DHCPAllocator extension notified of DHCPDECLINE, sent when a
+// client finds its offered address already in use.
+type DHCPDecliner interface {
+	Decline(req *DHCPRequest) error
+}
+
 type DHCPAllocatorFunc func(req *DHCPRequest) (*DHCPOffer, error)
 
 func (f DHCPAllocatorFunc) Offer(req *DHCPRequest) (*DHCPOffer, error) {
@@ -54,6 +115,16 @@ func (s *Server) startDHCP(ctx context.Context) error {
 		return err
 	}
 
+	if store := s.Options.DHCPLeaseStore; store != nil {
+		if restorer, ok := s.Options.DHCPAllocator.(DHCPLeaseRestorer); ok {
+			leases, err := store.All()
+			if err != nil {
+				return fmt.Errorf("load leases: %w", err)
+			}
+			restorer.RestoreLeases(leases)
+		}
+	}
+
 	server, err := server4.NewServer("", addr, s.dhcpHandler, server4.WithSummaryLogger())
 	if err != nil {
 		return err
@@ -80,39 +151,121 @@ func (s *Server) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv
 		return
 	}
 
-	req := &DHCPRequest{
-		MessageType: m.MessageType(),
-		XID:         binary.BigEndian.Uint32(m.TransactionID[:]),
-		ClientMAC:   m.ClientHWAddr,
-		RequestedIP: m.RequestedIPAddress(),
-		CurrentIP:   m.ClientIPAddr,
-		GatewayIP:   m.GatewayIPAddr,
+	req := newDHCPRequest(m)
+
+	if s.Options.ProxyDHCP {
+		// Leave address assignment to the network's DHCP server; only PXE discovers get
+		// an answer, and that answer is boot information alone.
+		if req.MessageType == dhcpv4.MessageTypeDiscover && req.IsPXE() {
+			if resp := s.proxyReply(m, req, dhcpv4.MessageTypeOffer); resp != nil {
+				dhcpSend(conn, dhcpReplyAddr(peer, m, resp), m, resp)
+			}
+		}
+		return
+	}
+
+	store := s.Options.DHCPLeaseStore
+
+	var msgType dhcpv4.MessageType
+	switch req.MessageType {
+	case dhcpv4.MessageTypeDiscover:
+		msgType = dhcpv4.MessageTypeOffer
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
+		msgType = dhcpv4.MessageTypeAck
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		s.dhcpFreeLease(req)
+		return
+	default:
+		return
+	}
+
+	serverIP := s.dhcpServerIP()
+
+	// A REQUEST naming another server means the client picked that server's offer.
+	if req.MessageType == dhcpv4.MessageTypeRequest && req.ServerID != nil &&
+		!serverIP.IsUnspecified() && !req.ServerID.Equal(serverIP) {
+		return
+	}
+
+	if store != nil && req.MessageType != dhcpv4.MessageTypeInform {
+		if lease, err := store.Get(req.ClientMAC); err == nil {
+			req.PreviousLease = lease
+		}
 	}
 
 	offer, err := s.Options.DHCPAllocator.Offer(req)
+	if errors.Is(err, ErrDHCPNak) && req.MessageType == dhcpv4.MessageTypeRequest {
+		s.dhcpSendNak(conn, peer, m, serverIP)
+		return
+	}
 	if err != nil || offer == nil {
 		return
 	}
 
-	msgType := dhcpv4.MessageTypeOffer
-	if req.MessageType == dhcpv4.MessageTypeRequest {
-		msgType = dhcpv4.MessageTypeAck
+	// INFORM replies carry configuration only (RFC 2131 §3.4).
+	inform := req.MessageType == dhcpv4.MessageTypeInform
+	if inform {
+		offer.YourIP = nil
+		offer.LeaseTime = 0
 	}
 
-	serverIP := s.Options.DHCPServerIP
-	if serverIP == nil {
-		if host, _, err := net.SplitHostPort(s.Options.ListenAddrDHCP); err == nil {
-			serverIP = net.ParseIP(host)
+	// Record the binding before acknowledging it so a crash cannot leave a client holding
+	// an address the next run would reissue. An unset LeaseTime is recorded as the pool
+	// default rather than as an already-expired lease.
+	if msgType == dhcpv4.MessageTypeAck && !inform && store != nil && offer.YourIP != nil {
+		leaseTime := offer.LeaseTime
+		if leaseTime <= 0 {
+			leaseTime = defaultPoolLeaseTime
+		}
+		lease := DHCPLease{
+			MAC:    append(net.HardwareAddr(nil), req.ClientMAC...),
+			IP:     offer.YourIP,
+			Expiry: time.Now().Add(leaseTime),
+		}
+		if err := store.Put(lease); err != nil {
+			return
 		}
 	}
-	if serverIP == nil {
-		serverIP = net.IPv4zero
+
+	resp, err := s.dhcpReply(m, msgType, offer, serverIP)
+	if err != nil {
+		return
+	}
+
+	dhcpSend(conn, dhcpReplyAddr(peer, m, resp), m, resp)
+}
+
+// newDHCPRequest extracts what allocators see from a client message.
+func newDHCPRequest(m *dhcpv4.DHCPv4) *DHCPRequest {
+	req := &DHCPRequest{
+		MessageType: m.MessageType(),
+		XID:         binary.BigEndian.Uint32(m.TransactionID[:]),
+		ClientMAC:   m.ClientHWAddr,
+		RequestedIP: m.RequestedIPAddress(),
+		CurrentIP:   m.ClientIPAddr,
+		GatewayIP:   m.GatewayIPAddr,
+		ServerID:    m.ServerIdentifier(),
 	}
+	parsePXEOptions(req, m)
 
+	if relay := m.RelayAgentInfo(); relay != nil {
+		req.RelayInfo = &DHCPRelayInfo{
+			CircuitID:  relay.Get(dhcpv4.AgentCircuitIDSubOption),
+			RemoteID:   relay.Get(dhcpv4.AgentRemoteIDSubOption),
+			SubOptions: relay.Options,
+		}
+	}
+	return req
+}
+
+// dhcpReply builds a reply of msgType to m carrying offer; extra modifiers are applied last.
+func (s *Server) dhcpReply(m *dhcpv4.DHCPv4, msgType dhcpv4.MessageType, offer *DHCPOffer, serverIP net.IP, extra ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, error) {
 	modifiers := []dhcpv4.Modifier{
 		dhcpv4.WithMessageType(msgType),
 		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
-		dhcpv4.WithYourIP(offer.YourIP),
+	}
+	if offer.YourIP != nil {
+		modifiers = append(modifiers, dhcpv4.WithYourIP(offer.YourIP))
 	}
 
 	if offer.SubnetMask != nil {
@@ -131,19 +284,139 @@ func (s *Server) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv
 		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(offer.LeaseTime)))
 	}
 	if offer.NextServer != nil {
-		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptTFTPServerName(offer.NextServer.String())))
+		modifiers = append(modifiers, dhcpv4.WithServerIP(offer.NextServer))
+	}
+
+	serverName := offer.ServerName
+	if serverName == "" && offer.NextServer != nil {
+		serverName = offer.NextServer.String()
+	}
+	if serverName != "" {
+		header, option := offer.BootPlacement.split(serverName, dhcpSnameLen)
+		if header {
+			modifiers = append(modifiers, func(d *dhcpv4.DHCPv4) { d.ServerHostName = serverName })
+		}
+		if option {
+			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptTFTPServerName(serverName)))
+		}
 	}
 	if offer.BootFile != "" {
-		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptBootFileName(offer.BootFile)))
+		header, option := offer.BootPlacement.split(offer.BootFile, dhcpFileLen)
+		if header {
+			modifiers = append(modifiers, func(d *dhcpv4.DHCPv4) { d.BootFileName = offer.BootFile })
+		}
+		if option {
+			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptBootFileName(offer.BootFile)))
+		}
+	}
+
+	for code, value := range offer.Options {
+		modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.GenericOptionCode(code), value))
+	}
+
+	return dhcpv4.NewReplyFromRequest(m, append(modifiers, extra...)...)
+}
+
+// split reports whether name goes into its header field (size bytes, NUL-terminated) and
+// whether it goes into the matching option.
+func (p BootPlacement) split(name string, size int) (header, option bool) {
+	fits := len(name) < size
+	switch p {
+	case BootPlacementHeader:
+		return fits, !fits
+	case BootPlacementOptions:
+		return false, true
+	default:
+		return fits, true
 	}
+}
+
+// dhcpSend encodes resp within the size the client accepts (option 57, never below the
+// RFC 2131 minimum) and with the options it asked for (option 55), then writes it to dst.
+func dhcpSend(conn net.PacketConn, dst net.Addr, m, resp *dhcpv4.DHCPv4) {
+	maxSize := dhcpMinMessageSize
+	if size, err := m.MaxMessageSize(); err == nil && int(size)-28 > maxSize {
+		maxSize = int(size) - 28
+	}
+	_, _ = conn.WriteTo(marshalDHCPv4(resp, maxSize, m.ParameterRequestList()), dst)
+}
 
-	resp, err := dhcpv4.NewReplyFromRequest(m, modifiers...)
+// dhcpReplyAddr picks where a reply goes (RFC 2131 §4.1): to the relay's server port
+// when relayed, unicast to ciaddr when the client has an address (except for NAKs), and
+// broadcast otherwise. Unicasting to yiaddr for clients that clear the broadcast flag
+// would need an ARP entry for an address the client does not hold yet, so they are
+// broadcast to as well.
+func dhcpReplyAddr(peer net.Addr, m, resp *dhcpv4.DHCPv4) net.Addr {
+	nak := resp.MessageType() == dhcpv4.MessageTypeNak
+
+	switch {
+	case isSetIPv4(m.GatewayIPAddr):
+		if nak {
+			resp.SetBroadcast()
+		}
+		return &net.UDPAddr{IP: m.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	case isSetIPv4(m.ClientIPAddr) && !nak:
+		return &net.UDPAddr{IP: m.ClientIPAddr, Port: dhcpv4.ClientPort}
+	case m.IsBroadcast(), nak:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	}
+
+	// A client without an address that still wants unicast: the source address is only
+	// usable if it is a real one (e.g. tests or a directly connected client).
+	if addr, ok := peer.(*net.UDPAddr); ok && isSetIPv4(addr.IP) && !addr.IP.Equal(net.IPv4bcast) {
+		return peer
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+}
+
+// dhcpServerIP is the address sent as (and matched against) the server identifier.
+func (s *Server) dhcpServerIP() net.IP {
+	serverIP := s.Options.DHCPServerIP
+	if serverIP == nil {
+		if host, _, err := net.SplitHostPort(s.Options.ListenAddrDHCP); err == nil {
+			serverIP = net.ParseIP(host)
+		}
+	}
+	if serverIP == nil {
+		serverIP = net.IPv4zero
+	}
+	return serverIP
+}
+
+// dhcpSendNak refuses a REQUEST. A NAK carries no address or configuration (RFC 2131
+// table 3).
+func (s *Server) dhcpSendNak(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4, serverIP net.IP) {
+	resp, err := dhcpv4.NewReplyFromRequest(m,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
+	)
+	if err != nil {
+		return
+	}
+	dhcpSend(conn, dhcpReplyAddr(peer, m, resp), m, resp)
+}
+
+// dhcpFreeLease handles RELEASE and DECLINE: the allocator is told (when it cares) and the
+// stored lease is forgotten. Neither message gets a reply.
+func (s *Server) dhcpFreeLease(req *DHCPRequest) {
+	var err error
+	switch allocator := s.Options.DHCPAllocator; req.MessageType {
+	case dhcpv4.MessageTypeRelease:
+		if releaser, ok := allocator.(DHCPReleaser); ok {
+			err = releaser.Release(req)
+		}
+	case dhcpv4.MessageTypeDecline:
+		if decliner, ok := allocator.(DHCPDecliner); ok {
+			err = decliner.Decline(req)
+		}
+	}
 	if err != nil {
 		return
 	}
 
-	raw := resp.ToBytes()
-	_, _ = conn.WriteTo(raw, peer)
+	if store := s.Options.DHCPLeaseStore; store != nil {
+		_ = store.Delete(req.ClientMAC)
+	}
 }
 
 // DHCPHandler exposes the DHCP handler for testing or embedding.
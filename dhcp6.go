@@ -0,0 +1,281 @@
+package tftp
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+const (
+	defaultDHCPv6PreferredLifetime = time.Hour
+	defaultDHCPv6ValidLifetime     = 2 * time.Hour
+)
+
+// DHCPv6Request represents a parsed DHCPv6 client message (relay wrappers removed).
+type DHCPv6Request struct {
+	MessageType dhcpv6.MessageType
+	ClientID    dhcpv6.DUID
+	// ClientMAC comes from the relay's client link-layer option or a DUID-LL/LLT, and is
+	// nil when neither is present.
+	ClientMAC net.HardwareAddr
+	// IAID identifies the client's first IA_NA; RequestedIPs lists the addresses in it.
+	IAID         [4]byte
+	RequestedIPs []net.IP
+	// LinkAddr is the innermost relay's link address, nil for unrelayed messages.
+	LinkAddr net.IP
+
+	// Netboot identification: option 61 architectures, option 15 user classes and
+	// option 16 vendor class data (e.g. "PXEClient:Arch:00007").
+	ClientArch  []iana.Arch
+	UserClass   [][]byte
+	VendorClass [][]byte
+
+	// RapidCommit is set on a Solicit that will be answered with a committed Reply: the
+	// client asked for rapid commit and Options.DHCPv6RapidCommit allows it. Allocators
+	// should bind the address then, as no Request follows.
+	RapidCommit bool
+}
+
+// DHCPv6Offer describes what the server will advertise or reply to a DHCPv6 client.
+type DHCPv6Offer struct {
+	// Address goes into the client's IA_NA; nil sends configuration only.
+	Address net.IP
+	// Lifetimes of Address (0 = 1h preferred, 2h valid). T1/T2 of 0 leave renewal timing
+	// to the client.
+	PreferredLifetime, ValidLifetime time.Duration
+	T1, T2                           time.Duration
+
+	DNSServers   []net.IP
+	DomainSearch []string
+
+	// BootFileURL (option 59) and BootFileParams (option 60) drive UEFI PXE/HTTP boot over
+	// IPv6 (RFC 5970), e.g. "tftp://[2001:db8::1]/ipxe.efi".
+	BootFileURL    string
+	BootFileParams []string
+}
+
+// DHCPv6Allocator decides what to offer to a DHCPv6 client.
+type DHCPv6Allocator interface {
+	Offer(req *DHCPv6Request) (*DHCPv6Offer, error)
+}
+
+// DHCPv6Releaser is an optional DHCPv6Allocator extension notified of Release messages.
+// req.RequestedIPs lists the addresses the client gives up.
+type DHCPv6Releaser interface {
+	Release(req *DHCPv6Request) error
+}
+
+type DHCPv6AllocatorFunc func(req *DHCPv6Request) (*DHCPv6Offer, error)
+
+func (f DHCPv6AllocatorFunc) Offer(req *DHCPv6Request) (*DHCPv6Offer, error) {
+	return f(req)
+}
+
+func (s *Server) startDHCPv6(ctx context.Context) error {
+	if s.Options.DHCPv6Allocator == nil || s.Options.ListenAddrDHCPv6 == "" {
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp6", s.Options.ListenAddrDHCPv6)
+	if err != nil {
+		return err
+	}
+
+	server, err := server6.NewServer("", addr, s.dhcpv6Handler, server6.WithSummaryLogger())
+	if err != nil {
+		return err
+	}
+
+	s.dhcpv6Server = server
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		_ = server.Serve()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	return nil
+}
+
+func (s *Server) dhcpv6Handler(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	msg, err := m.GetInnerMessage()
+	if err != nil {
+		return
+	}
+
+	req := newDHCPv6Request(m, msg)
+	if !s.dhcpMACAllowed(req.ClientMAC) {
+		return
+	}
+	req.RapidCommit = s.Options.DHCPv6RapidCommit && req.MessageType == dhcpv6.MessageTypeSolicit &&
+		msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil
+
+	serverID := s.dhcpv6ServerID()
+	clientServerID := msg.Options.ServerID()
+
+	// Messages addressed to a server must name us; Solicit and Rebind go to any server
+	// and must not name one (RFC 8415 §16).
+	switch req.MessageType {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRebind:
+		if clientServerID != nil {
+			return
+		}
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRelease:
+		if clientServerID == nil || !clientServerID.Equal(serverID) {
+			return
+		}
+	case dhcpv6.MessageTypeInformationRequest:
+		if clientServerID != nil && !clientServerID.Equal(serverID) {
+			return
+		}
+	default:
+		return
+	}
+
+	modifiers := []dhcpv6.Modifier{dhcpv6.WithServerID(serverID)}
+
+	if req.MessageType == dhcpv6.MessageTypeRelease {
+		// Release is always acknowledged (RFC 8415 §18.3.7); the allocator only needs to
+		// free what it holds.
+		if releaser, ok := s.Options.DHCPv6Allocator.(DHCPv6Releaser); ok {
+			_ = releaser.Release(req)
+		}
+		modifiers = append(modifiers, dhcpv6.WithOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}))
+	} else {
+		offer, err := s.Options.DHCPv6Allocator.Offer(req)
+		if err != nil || offer == nil {
+			return
+		}
+		modifiers = append(modifiers, dhcpv6OfferModifiers(req, offer)...)
+	}
+
+	var reply *dhcpv6.Message
+	if req.MessageType == dhcpv6.MessageTypeSolicit && !req.RapidCommit {
+		reply, err = dhcpv6.NewAdvertiseFromSolicit(msg, modifiers...)
+	} else {
+		// A Solicit with rapid commit gets the Reply straight away (RFC 8415 §18.3.1).
+		reply, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+	}
+	if err != nil {
+		return
+	}
+
+	var resp dhcpv6.DHCPv6 = reply
+	if relay, ok := m.(*dhcpv6.RelayMessage); ok {
+		if resp, err = dhcpv6.NewRelayReplFromRelayForw(relay, reply); err != nil {
+			return
+		}
+	}
+
+	_, _ = conn.WriteTo(resp.ToBytes(), peer)
+}
+
+// DHCPv6Handler exposes the DHCPv6 handler for testing or embedding.
+func (s *Server) DHCPv6Handler(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	s.dhcpv6Handler(conn, peer, m)
+}
+
+// newDHCPv6Request extracts what allocators see from a client message; m is the message
+// as received, msg the client message inside any relay wrappers.
+func newDHCPv6Request(m dhcpv6.DHCPv6, msg *dhcpv6.Message) *DHCPv6Request {
+	req := &DHCPv6Request{
+		MessageType: msg.Type(),
+		ClientID:    msg.Options.ClientID(),
+		ClientArch:  msg.Options.ArchTypes(),
+		UserClass:   msg.Options.UserClasses(),
+	}
+
+	if mac, err := dhcpv6.ExtractMAC(m); err == nil {
+		req.ClientMAC = mac
+	}
+
+	if ia := msg.Options.OneIANA(); ia != nil {
+		req.IAID = ia.IaId
+		for _, addr := range ia.Options.Addresses() {
+			req.RequestedIPs = append(req.RequestedIPs, addr.IPv6Addr)
+		}
+	}
+
+	for _, vc := range msg.Options.VendorClasses() {
+		req.VendorClass = append(req.VendorClass, vc.Data...)
+	}
+
+	if m.IsRelay() {
+		if inner, err := dhcpv6.DecapsulateRelayIndex(m, -1); err == nil {
+			if relay, ok := inner.(*dhcpv6.RelayMessage); ok {
+				req.LinkAddr = relay.LinkAddr
+			}
+		}
+	}
+
+	return req
+}
+
+// dhcpv6OfferModifiers renders an offer: an IA_NA for the client's IAID (skipped for
+// Information-request) followed by configuration and boot options.
+func dhcpv6OfferModifiers(req *DHCPv6Request, offer *DHCPv6Offer) []dhcpv6.Modifier {
+	var modifiers []dhcpv6.Modifier
+
+	if offer.Address != nil && req.MessageType != dhcpv6.MessageTypeInformationRequest {
+		preferred, valid := offer.PreferredLifetime, offer.ValidLifetime
+		if preferred <= 0 {
+			preferred = defaultDHCPv6PreferredLifetime
+		}
+		if valid < preferred {
+			valid = max(preferred, defaultDHCPv6ValidLifetime)
+		}
+
+		ia := &dhcpv6.OptIANA{IaId: req.IAID, T1: offer.T1, T2: offer.T2}
+		ia.Options.Add(&dhcpv6.OptIAAddress{
+			IPv6Addr:          offer.Address,
+			PreferredLifetime: preferred,
+			ValidLifetime:     valid,
+		})
+		modifiers = append(modifiers, dhcpv6.WithOption(ia))
+	}
+
+	if len(offer.DNSServers) > 0 {
+		modifiers = append(modifiers, dhcpv6.WithDNS(offer.DNSServers...))
+	}
+	if len(offer.DomainSearch) > 0 {
+		modifiers = append(modifiers, dhcpv6.WithDomainSearchList(offer.DomainSearch...))
+	}
+	if offer.BootFileURL != "" {
+		modifiers = append(modifiers, dhcpv6.WithOption(dhcpv6.OptBootFileURL(offer.BootFileURL)))
+	}
+	if len(offer.BootFileParams) > 0 {
+		modifiers = append(modifiers, dhcpv6.WithOption(dhcpv6.OptBootFileParam(offer.BootFileParams...)))
+	}
+
+	return modifiers
+}
+
+// dhcpv6ServerID returns Options.DHCPv6ServerID, or a DUID-LL from the first usable
+// interface, or failing that a random DUID-UUID. Generated IDs are kept for the life of
+// the Server.
+func (s *Server) dhcpv6ServerID() dhcpv6.DUID {
+	if s.Options.DHCPv6ServerID != nil {
+		return s.Options.DHCPv6ServerID
+	}
+
+	s.dhcpv6DUIDOnce.Do(func() {
+		if duid, err := dhcpv6.GetDUIDLL(); err == nil {
+			s.dhcpv6DUID = duid
+			return
+		}
+		duid := &dhcpv6.DUIDUUID{}
+		_, _ = rand.Read(duid.UUID[:])
+		s.dhcpv6DUID = duid
+	})
+	return s.dhcpv6DUID
+}
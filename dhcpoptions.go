@@ -0,0 +1,75 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+)
+
+// SetOption sets a raw option value, e.g. for site-specific options 224–254. Options set
+// this way take precedence over the equivalent DHCPOffer fields.
+func (o *DHCPOffer) SetOption(code uint8, value []byte) {
+	if o.Options == nil {
+		o.Options = make(dhcpv4.Options)
+	}
+	o.Options[code] = value
+}
+
+func (o *DHCPOffer) setOption(opt dhcpv4.Option) {
+	o.SetOption(opt.Code.Code(), opt.Value.ToBytes())
+}
+
+// SetNTPServers sets option 42.
+func (o *DHCPOffer) SetNTPServers(servers ...net.IP) {
+	o.setOption(dhcpv4.OptNTPServers(servers...))
+}
+
+// SetStaticRoutes sets classless static routes (option 121). Clients that support it
+// ignore Router (RFC 3442), so include a 0.0.0.0/0 route when one is needed.
+func (o *DHCPOffer) SetStaticRoutes(routes ...*dhcpv4.Route) {
+	o.setOption(dhcpv4.OptClasslessStaticRoute(routes...))
+}
+
+// SetMTU sets the interface MTU (option 26).
+func (o *DHCPOffer) SetMTU(mtu uint16) {
+	o.SetOption(dhcpv4.OptionInterfaceMTU.Code(), binary.BigEndian.AppendUint16(nil, mtu))
+}
+
+// SetHostName sets option 12.
+func (o *DHCPOffer) SetHostName(name string) {
+	o.setOption(dhcpv4.OptHostName(name))
+}
+
+// SetSearchDomains sets the domain search list (option 119).
+func (o *DHCPOffer) SetSearchDomains(domains ...string) {
+	o.setOption(dhcpv4.OptDomainSearch(&rfc1035label.Labels{Labels: domains}))
+}
+
+// SetVendorOptions sets vendor-specific information (option 43) from sub-options, e.g.
+// the PXE boot menu (9) and prompt (10) sub-options. Sub-options are written in code
+// order and terminated with 255. A sub-option longer than 255 bytes cannot be encoded;
+// it is rejected with an error and option 43 is left unchanged.
+func (o *DHCPOffer) SetVendorOptions(sub map[uint8][]byte) error {
+	codes := make([]int, 0, len(sub))
+	for code, data := range sub {
+		if len(data) > math.MaxUint8 {
+			return fmt.Errorf("vendor sub-option %d is %d bytes, limit is %d", code, len(data), math.MaxUint8)
+		}
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	var value []byte
+	for _, code := range codes {
+		data := sub[uint8(code)]
+		value = append(value, uint8(code), uint8(len(data)))
+		value = append(value, data...)
+	}
+	o.SetOption(dhcpv4.OptionVendorSpecificInformation.Code(), append(value, 255))
+	return nil
+}
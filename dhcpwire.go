@@ -0,0 +1,201 @@
+package tftp
+
+import (
+	"math"
+	"sort"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// dhcpFixedLen covers the BOOTP header and the magic cookie.
+	dhcpFixedLen    = 240
+	dhcpSnameOffset = 44
+	dhcpFileOffset  = dhcpSnameOffset + dhcpSnameLen
+	bootpMinLen     = 300
+
+	dhcpOverloadFile  = 1
+	dhcpOverloadSname = 2
+)
+
+// optionArea accumulates encoded options up to room bytes.
+type optionArea struct {
+	room int
+	data []byte
+}
+
+func (a *optionArea) put(encoded []byte) bool {
+	if len(encoded) > a.room-len(a.data) {
+		return false
+	}
+	a.data = append(a.data, encoded...)
+	return true
+}
+
+// encodeOption renders one option, split into several instances when longer than 255
+// bytes (RFC 3396).
+func encodeOption(code uint8, data []byte) []byte {
+	if len(data) == 0 {
+		return []byte{code, 0}
+	}
+
+	var out []byte
+	for len(data) > 0 {
+		n := min(len(data), math.MaxUint8)
+		out = append(out, code, uint8(n))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+// dhcpAlwaysSent lists options included in replies whether or not the client asked for
+// them in option 55. Boot server and file are among them: BootPlacementOptions may leave
+// no other place for them, and PXE ROMs do not always ask.
+var dhcpAlwaysSent = map[uint8]bool{
+	dhcpv4.OptionDHCPMessageType.Code():           true,
+	dhcpv4.OptionServerIdentifier.Code():          true,
+	dhcpv4.OptionIPAddressLeaseTime.Code():        true,
+	dhcpv4.OptionRenewTimeValue.Code():            true,
+	dhcpv4.OptionRebindingTimeValue.Code():        true,
+	dhcpv4.OptionSubnetMask.Code():                true,
+	dhcpv4.OptionClientIdentifier.Code():          true,
+	dhcpv4.OptionTFTPServerName.Code():            true,
+	dhcpv4.OptionBootfileName.Code():              true,
+	dhcpv4.OptionClassIdentifier.Code():           true,
+	dhcpv4.OptionVendorSpecificInformation.Code(): true,
+	dhcpv4.OptionClientMachineIdentifier.Code():   true,
+	dhcpv4.OptionRelayAgentInformation.Code():     true,
+}
+
+// marshalDHCPv4 serializes resp in at most maxSize bytes. With a parameter request list
+// (option 55), options the client did not ask for are left out, except dhcpAlwaysSent,
+// and the rest follow the client's order. Message type and server identifier come first,
+// relay information last (RFC 3046 §2.1).
+//
+// When the options do not fit, those that do not are moved into the file and then sname
+// header fields, whichever are not carrying names, and option 52 announces it (RFC 2132
+// §9.3). Options that fit nowhere are dropped.
+func marshalDHCPv4(resp *dhcpv4.DHCPv4, maxSize int, requested dhcpv4.OptionCodeList) []byte {
+	raw := resp.ToBytes()
+	if len(raw) <= maxSize && len(requested) == 0 {
+		return raw
+	}
+
+	var (
+		first = []uint8{dhcpv4.OptionDHCPMessageType.Code(), dhcpv4.OptionServerIdentifier.Code()}
+		relay = dhcpv4.OptionRelayAgentInformation.Code()
+		rank  = make(map[uint8]int, len(requested))
+		rest  []uint8
+	)
+	for i, code := range requested {
+		if _, seen := rank[code.Code()]; !seen {
+			rank[code.Code()] = i
+		}
+	}
+	for code := range resp.Options {
+		switch code {
+		case first[0], first[1], relay, dhcpv4.OptionEnd.Code(), dhcpv4.OptionPad.Code():
+			continue
+		}
+		if _, asked := rank[code]; len(rank) > 0 && !asked && !dhcpAlwaysSent[code] {
+			continue
+		}
+		rest = append(rest, code)
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		ri, iok := rank[rest[i]]
+		rj, jok := rank[rest[j]]
+		if iok != jok {
+			return iok
+		}
+		if iok {
+			return ri < rj
+		}
+		return rest[i] < rest[j]
+	})
+
+	var (
+		head []byte
+		body [][]byte
+		size int
+	)
+	for _, code := range first {
+		if data, ok := resp.Options[code]; ok {
+			head = append(head, encodeOption(code, data)...)
+		}
+	}
+	var relayOption []byte
+	if data, ok := resp.Options[relay]; ok {
+		relayOption = encodeOption(relay, data)
+	}
+	for _, code := range rest {
+		encoded := encodeOption(code, resp.Options[code])
+		body = append(body, encoded)
+		size += len(encoded)
+	}
+
+	// Each area needs a byte for its end marker.
+	var (
+		main        = &optionArea{room: maxSize - dhcpFixedLen - 1 - len(relayOption), data: head}
+		file, sname = &optionArea{room: dhcpFileLen - 1}, &optionArea{room: dhcpSnameLen - 1}
+		spill       []*optionArea
+	)
+	if len(head)+size > main.room {
+		if resp.BootFileName == "" {
+			spill = append(spill, file)
+		}
+		if resp.ServerHostName == "" {
+			spill = append(spill, sname)
+		}
+		if len(spill) > 0 {
+			main.room -= 3 // option 52
+		}
+	}
+
+	for _, encoded := range body {
+		if main.put(encoded) {
+			continue
+		}
+		for _, area := range spill {
+			if area.put(encoded) {
+				break
+			}
+		}
+	}
+
+	var overload uint8
+	if len(file.data) > 0 {
+		overload |= dhcpOverloadFile
+	}
+	if len(sname.data) > 0 {
+		overload |= dhcpOverloadSname
+	}
+
+	out := append([]byte(nil), raw[:dhcpFixedLen]...)
+	if overload != 0 {
+		out = fillHeaderField(out, dhcpFileOffset, dhcpFileLen, file.data)
+		out = fillHeaderField(out, dhcpSnameOffset, dhcpSnameLen, sname.data)
+		out = append(out, dhcpv4.OptionOptionOverload.Code(), 1, overload)
+	}
+	out = append(out, main.data...)
+	out = append(out, relayOption...)
+	out = append(out, dhcpv4.OptionEnd.Code())
+	for len(out) < bootpMinLen {
+		out = append(out, dhcpv4.OptionPad.Code())
+	}
+	return out
+}
+
+// fillHeaderField replaces an overloaded sname or file field with options. Unused fields
+// are left alone.
+func fillHeaderField(packet []byte, offset, size int, options []byte) []byte {
+	if len(options) == 0 {
+		return packet
+	}
+	field := packet[offset : offset+size]
+	clear(field)
+	copy(field, options)
+	field[len(options)] = dhcpv4.OptionEnd.Code()
+	return packet
+}
@@ -0,0 +1,115 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// scanOptions decodes an options area up to its end marker, concatenating repeated codes.
+func scanOptions(t *testing.T, area []byte, into map[uint8][]byte) {
+	t.Helper()
+
+	for i := 0; i < len(area); {
+		code := area[i]
+		if code == dhcpv4.OptionEnd.Code() {
+			return
+		}
+		if code == dhcpv4.OptionPad.Code() {
+			i++
+			continue
+		}
+		if i+2 > len(area) || i+2+int(area[i+1]) > len(area) {
+			t.Fatalf("truncated option %d at %d", code, i)
+		}
+		into[code] = append(into[code], area[i+2:i+2+int(area[i+1])]...)
+		i += 2 + int(area[i+1])
+	}
+	t.Fatalf("options area without end marker")
+}
+
+func TestMarshalDHCPv4Overload(t *testing.T) {
+	resp, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 1))),
+		dhcpv4.WithOption(dhcpv4.OptHostName(strings.Repeat("h", 90))),
+		dhcpv4.WithOption(dhcpv4.OptDomainName(strings.Repeat("d", 150))),
+		dhcpv4.WithOption(dhcpv4.OptRootPath(strings.Repeat("r", 100))),
+		dhcpv4.WithGeneric(dhcpv4.OptionRelayAgentInformation, []byte{1, 2, 'a', 'b'}),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	if raw := marshalDHCPv4(resp, 1500, nil); !bytes.Equal(raw, resp.ToBytes()) {
+		t.Fatalf("expected packets that fit to be marshalled unchanged")
+	}
+
+	raw := marshalDHCPv4(resp, dhcpMinMessageSize, nil)
+	if len(raw) > dhcpMinMessageSize {
+		t.Fatalf("packet is %d bytes, limit %d", len(raw), dhcpMinMessageSize)
+	}
+
+	main := make(map[uint8][]byte)
+	scanOptions(t, raw[dhcpFixedLen:], main)
+	overload := main[dhcpv4.OptionOptionOverload.Code()]
+	if len(overload) != 1 || overload[0]&dhcpOverloadFile == 0 {
+		t.Fatalf("expected option 52 to announce the file field, got %v", overload)
+	}
+
+	all := make(map[uint8][]byte)
+	for code, data := range main {
+		all[code] = data
+	}
+	scanOptions(t, raw[dhcpFileOffset:dhcpFileOffset+dhcpFileLen], all)
+	if overload[0]&dhcpOverloadSname != 0 {
+		scanOptions(t, raw[dhcpSnameOffset:dhcpSnameOffset+dhcpSnameLen], all)
+	}
+
+	for code, want := range resp.Options {
+		if !bytes.Equal(all[code], want) {
+			t.Fatalf("option %d = %q, want %q", code, all[code], want)
+		}
+	}
+
+	// Relay information stays last in the options area.
+	tail := bytes.TrimRight(raw, "\x00")
+	if !bytes.HasSuffix(tail, []byte{82, 4, 1, 2, 'a', 'b', 255}) {
+		t.Fatalf("expected option 82 to end the options area")
+	}
+}
+
+func TestMarshalDHCPv4KeepsNamedHeaderFields(t *testing.T) {
+	resp, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.WithOption(dhcpv4.OptDomainName(strings.Repeat("d", 250))),
+		dhcpv4.WithOption(dhcpv4.OptHostName(strings.Repeat("h", 100))),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	resp.BootFileName = "pxelinux.0"
+	resp.ServerHostName = "tftp.example"
+
+	raw := marshalDHCPv4(resp, dhcpMinMessageSize, nil)
+	if len(raw) > dhcpMinMessageSize {
+		t.Fatalf("packet is %d bytes, limit %d", len(raw), dhcpMinMessageSize)
+	}
+
+	parsed, err := dhcpv4.FromBytes(raw)
+	if err != nil {
+		t.Fatalf("FromBytes failed: %v", err)
+	}
+	if parsed.BootFileName != "pxelinux.0" || parsed.ServerHostName != "tftp.example" {
+		t.Fatalf("header names overwritten: %q %q", parsed.ServerHostName, parsed.BootFileName)
+	}
+	if parsed.Options.Has(dhcpv4.OptionOptionOverload) || parsed.Options.Has(dhcpv4.OptionDomainName) {
+		t.Fatalf("expected the option that fits nowhere to be dropped without overload")
+	}
+	if parsed.HostName() != strings.Repeat("h", 100) {
+		t.Fatalf("expected options that fit to be kept")
+	}
+}
@@ -0,0 +1,78 @@
+package tftp
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+)
+
+// Sentinel errors a Getter or Putter can return (directly or wrapped) to control what the
+// client sees. fs.ErrNotExist and fs.ErrPermission are treated like ErrNotFound and
+// ErrAccessDenied so file-backed getters work without translation.
+var (
+	ErrNotFound     = errors.New("file not found")
+	ErrAccessDenied = errors.New("access denied")
+	ErrDiskFull     = errors.New("disk full or allocation exceeded")
+	ErrUnavailable  = errors.New("temporarily unavailable")
+)
+
+// RedirectError sends HTTP clients to Location with a 302. TFTP has no redirect, so TFTP
+// clients see "File not found".
+type RedirectError struct {
+	Location string
+}
+
+func (e *RedirectError) Error() string {
+	return "redirect to " + e.Location
+}
+
+var tftpErrorMessages = map[int]string{
+	ERROR_UNDEFINED:        "Transfer failed",
+	ERROR_FILE_NOT_FOUND:   "File not found",
+	ERROR_ACCESS_VIOLATION: "Access violation",
+	ERROR_DISK_FULL:        "Disk full or allocation exceeded",
+}
+
+// tftpErrorFor maps a getter or putter error to an RFC 1350 error code and the message
+// sent to the client. Unclassified errors use fallback; their text is only echoed when
+// expose is set.
+func tftpErrorFor(err error, fallback int, expose bool) (int, string) {
+	code, msg := fallback, ""
+
+	var redirect *RedirectError
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, fs.ErrNotExist), errors.As(err, &redirect):
+		code = ERROR_FILE_NOT_FOUND
+	case errors.Is(err, ErrAccessDenied), errors.Is(err, fs.ErrPermission):
+		code = ERROR_ACCESS_VIOLATION
+	case errors.Is(err, ErrDiskFull), errors.Is(err, ErrTransferTooLargeTFTP):
+		code = ERROR_DISK_FULL
+	case errors.Is(err, ErrUnavailable):
+		code, msg = ERROR_UNDEFINED, "Temporarily unavailable"
+	}
+
+	if expose {
+		return code, err.Error()
+	}
+	if msg == "" {
+		msg = tftpErrorMessages[code]
+	}
+	return code, msg
+}
+
+// httpStatusFor maps a getter error to an HTTP status. Unclassified errors stay 404.
+func httpStatusFor(err error) int {
+	var redirect *RedirectError
+	switch {
+	case errors.As(err, &redirect):
+		return http.StatusFound
+	case errors.Is(err, ErrAccessDenied), errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrDiskFull):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusNotFound
+	}
+}
@@ -2,10 +2,12 @@ module github.com/opnlaas/tftp
 
 go 1.24.9
 
+require github.com/insomniacslk/dhcp v0.0.0-20251020182700-175e84fbb167
+
 require (
-	github.com/insomniacslk/dhcp v0.0.0-20251020182700-175e84fbb167 // indirect
 	github.com/josharian/native v1.1.0 // indirect
 	github.com/pierrec/lz4/v4 v4.1.14 // indirect
 	github.com/u-root/uio v0.0.0-20230220225925-ffce2a382923 // indirect
+	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 )
@@ -0,0 +1,324 @@
+package tftp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// compactMinRecords keeps tiny journals from being rewritten on every change.
+	compactMinRecords = 256
+	// defaultExpiredRetention is how long compaction keeps leases past their expiry.
+	defaultExpiredRetention = 24 * time.Hour
+)
+
+// DHCPLease records an address bound (or, during DISCOVER, held) for a client.
+type DHCPLease struct {
+	MAC    net.HardwareAddr
+	IP     net.IP
+	Expiry time.Time
+}
+
+// DHCPLeaseStore persists bound leases so a restart does not reissue addresses. The DHCP
+// handler looks a client up before calling the allocator, records every ACKed lease, and
+// seeds allocators implementing DHCPLeaseRestorer on Start.
+type DHCPLeaseStore interface {
+	// Get returns the stored lease for mac, or nil if there is none.
+	Get(mac net.HardwareAddr) (*DHCPLease, error)
+	Put(lease DHCPLease) error
+	Delete(mac net.HardwareAddr) error
+	All() ([]DHCPLease, error)
+}
+
+// DHCPLeaseRestorer is an optional DHCPAllocator extension that accepts the persisted
+// lease table on Start, so addresses held by absent clients are not handed out again.
+type DHCPLeaseRestorer interface {
+	RestoreLeases(leases []DHCPLease)
+}
+
+// FileLeaseStore is a DHCPLeaseStore backed by an append-only JSON-lines journal. Every
+// change is appended and synced; the journal is rewritten atomically once stale records
+// outnumber live ones.
+type FileLeaseStore struct {
+	// ExpiredRetention is how long past its expiry a lease survives compaction (0 = 24h).
+	ExpiredRetention time.Duration
+
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	leases  map[string]DHCPLease
+	records int
+}
+
+type leaseRecord struct {
+	Op     string    `json:"op"`
+	MAC    string    `json:"mac"`
+	IP     string    `json:"ip,omitempty"`
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+const (
+	leaseOpPut    = "put"
+	leaseOpDelete = "del"
+)
+
+// NewFileLeaseStore opens (or creates) the journal at path and replays it. A truncated
+// final line, e.g. from a crash mid-write, is ignored and cut off so new records start on
+// a line of their own.
+func NewFileLeaseStore(path string) (*FileLeaseStore, error) {
+	s := &FileLeaseStore{
+		path:   path,
+		leases: make(map[string]DHCPLease),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// load replays the journal and truncates it after the last complete line.
+func (s *FileLeaseStore) load() error {
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		reader = bufio.NewReader(file)
+		good   int64
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		good += int64(len(line))
+
+		var rec leaseRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			continue
+		}
+		s.apply(rec)
+		s.records++
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > good {
+		if err := file.Truncate(good); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+	return nil
+}
+
+func (s *FileLeaseStore) apply(rec leaseRecord) {
+	mac, ok := normalizeMACString(rec.MAC)
+	if !ok {
+		return
+	}
+
+	switch rec.Op {
+	case leaseOpPut:
+		hw, _ := net.ParseMAC(mac)
+		ip := net.ParseIP(rec.IP)
+		if ip == nil {
+			return
+		}
+		s.leases[mac] = DHCPLease{MAC: hw, IP: ip, Expiry: rec.Expiry}
+	case leaseOpDelete:
+		delete(s.leases, mac)
+	}
+}
+
+// Get implements DHCPLeaseStore.
+func (s *FileLeaseStore) Get(mac net.HardwareAddr) (*DHCPLease, error) {
+	key, ok := normalizeMACString(mac.String())
+	if !ok {
+		return nil, fmt.Errorf("invalid MAC %q", mac)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease, ok := s.leases[key]
+	if !ok {
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// Put implements DHCPLeaseStore.
+func (s *FileLeaseStore) Put(lease DHCPLease) error {
+	return s.append(leaseRecord{
+		Op:     leaseOpPut,
+		MAC:    lease.MAC.String(),
+		IP:     lease.IP.String(),
+		Expiry: lease.Expiry.UTC(),
+	})
+}
+
+// Delete implements DHCPLeaseStore.
+func (s *FileLeaseStore) Delete(mac net.HardwareAddr) error {
+	return s.append(leaseRecord{Op: leaseOpDelete, MAC: mac.String()})
+}
+
+// All implements DHCPLeaseStore; leases are ordered by IP.
+func (s *FileLeaseStore) All() ([]DHCPLease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]DHCPLease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		out = append(out, lease)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return ipToUint32(out[i].IP) < ipToUint32(out[j].IP)
+	})
+	return out, nil
+}
+
+func (s *FileLeaseStore) append(rec leaseRecord) error {
+	if _, ok := normalizeMACString(rec.MAC); !ok {
+		return fmt.Errorf("invalid MAC %q", rec.MAC)
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("lease store closed")
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.apply(rec)
+	s.records++
+
+	if s.records > compactMinRecords && s.records > 2*len(s.leases) {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// Compact rewrites the journal with one record per live lease, dropping leases that
+// expired more than ExpiredRetention ago.
+func (s *FileLeaseStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("lease store closed")
+	}
+	return s.compactLocked()
+}
+
+func (s *FileLeaseStore) compactLocked() error {
+	retention := s.ExpiredRetention
+	if retention <= 0 {
+		retention = defaultExpiredRetention
+	}
+	cutoff := time.Now().Add(-retention)
+	for key, lease := range s.leases {
+		if lease.Expiry.Before(cutoff) {
+			delete(s.leases, key)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, lease := range s.leases {
+		line, err := json.Marshal(leaseRecord{
+			Op:     leaseOpPut,
+			MAC:    lease.MAC.String(),
+			IP:     lease.IP.String(),
+			Expiry: lease.Expiry.UTC(),
+		})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, _ = w.Write(append(line, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_ = s.file.Close()
+	s.file = file
+	s.records = len(s.leases)
+
+	return nil
+}
+
+// Close flushes nothing (every write is synced) and releases the journal file.
+func (s *FileLeaseStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,173 @@
+package tftp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// netasciiEncoder translates a stream to netascii (LF -> CR LF, CR -> CR NUL) as it is read.
+// Seeking rewinds the source and re-encodes up to the target offset; the TFTP sender only
+// seeks backwards when a window has to be resent, so this stays cheap in practice.
+type netasciiEncoder struct {
+	src  io.ReadSeeker
+	base int64
+	r    *bufio.Reader
+
+	pos        int64 // encoded bytes produced so far
+	pending    byte
+	hasPending bool
+}
+
+func newNetasciiEncoder(src io.ReadSeeker) (*netasciiEncoder, error) {
+	base, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &netasciiEncoder{src: src, base: base, r: bufio.NewReader(src)}, nil
+}
+
+func (e *netasciiEncoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if e.hasPending {
+			p[n] = e.pending
+			e.hasPending = false
+			n++
+			continue
+		}
+
+		c, err := e.r.ReadByte()
+		if err != nil {
+			e.pos += int64(n)
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+
+		switch c {
+		case '\n':
+			p[n] = '\r'
+			e.pending, e.hasPending = '\n', true
+		case '\r':
+			p[n] = '\r'
+			e.pending, e.hasPending = 0, true
+		default:
+			p[n] = c
+		}
+		n++
+	}
+
+	e.pos += int64(n)
+	return n, nil
+}
+
+func (e *netasciiEncoder) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += e.pos
+	default:
+		return 0, errors.New("netascii: unsupported seek whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("netascii: negative position")
+	}
+
+	if offset < e.pos {
+		if _, err := e.src.Seek(e.base, io.SeekStart); err != nil {
+			return 0, err
+		}
+		e.r.Reset(e.src)
+		e.pos, e.hasPending = 0, false
+	}
+
+	if offset > e.pos {
+		if _, err := io.CopyN(io.Discard, e, offset-e.pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	return e.pos, nil
+}
+
+// netasciiSize returns the encoded length of src from its current offset and restores the
+// offset afterwards.
+func netasciiSize(src io.ReadSeeker) (int64, error) {
+	start, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		size int64
+		buf  = make([]byte, 32*1024)
+	)
+	for {
+		n, err := src.Read(buf)
+		size += int64(n)
+		for _, c := range buf[:n] {
+			if c == '\n' || c == '\r' {
+				size++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = src.Seek(start, io.SeekStart)
+	return size, err
+}
+
+// netasciiDecoder reverses netascii on the way to w (CR LF -> LF, CR NUL -> CR). A CR at
+// the end of one write is held until the next byte shows what it was; Flush emits it.
+type netasciiDecoder struct {
+	w  io.Writer
+	cr bool
+}
+
+func (d *netasciiDecoder) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if d.cr {
+			d.cr = false
+			switch c {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				out = append(out, '\r')
+			}
+		}
+
+		if c == '\r' {
+			d.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+
+	if _, err := d.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a trailing bare CR, if any.
+func (d *netasciiDecoder) Flush() error {
+	if !d.cr {
+		return nil
+	}
+	d.cr = false
+	_, err := d.w.Write([]byte{'\r'})
+	return err
+}
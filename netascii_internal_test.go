@@ -0,0 +1,53 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNetasciiEncoderSeekReencodes(t *testing.T) {
+	enc, err := newNetasciiEncoder(strings.NewReader("a\nb\rc\n"))
+	if err != nil {
+		t.Fatalf("newNetasciiEncoder failed: %v", err)
+	}
+
+	all, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if want := "a\r\nb\r\x00c\r\n"; string(all) != want {
+		t.Fatalf("unexpected encoding %q, want %q", all, want)
+	}
+
+	// Rewind into the middle of an expanded pair, as a window rollback would.
+	if pos, err := enc.Seek(2, io.SeekStart); err != nil || pos != 2 {
+		t.Fatalf("seek failed: pos=%d err=%v", pos, err)
+	}
+	rest, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatalf("read after seek failed: %v", err)
+	}
+	if want := "\nb\r\x00c\r\n"; string(rest) != want {
+		t.Fatalf("unexpected encoding after seek %q, want %q", rest, want)
+	}
+}
+
+func TestNetasciiDecoderAcrossWrites(t *testing.T) {
+	var out bytes.Buffer
+	dec := &netasciiDecoder{w: &out}
+
+	for _, chunk := range []string{"line1\r", "\nline2\r", "\x00x\r"} {
+		if _, err := dec.Write([]byte(chunk)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := dec.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if want := "line1\nline2\rx\r"; out.String() != want {
+		t.Fatalf("unexpected decoding %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,499 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	defaultPoolLeaseTime  = time.Hour
+	defaultPoolOfferHold  = time.Minute
+	defaultPoolQuarantine = time.Hour
+)
+
+// ErrPoolExhausted is returned by PoolAllocator when a subnet has no address left to offer.
+var ErrPoolExhausted = errors.New("dhcp pool exhausted")
+
+// DHCPSubnet describes one IPv4 address pool served by a PoolAllocator.
+type DHCPSubnet struct {
+	// Network is the subnet itself; its mask is offered to clients.
+	Network *net.IPNet
+	// RangeStart and RangeEnd bound the dynamic pool (inclusive). When unset they default
+	// to the first and last host addresses of Network.
+	RangeStart, RangeEnd net.IP
+	// Exclude lists addresses inside the range that must never be handed out.
+	Exclude []net.IP
+	// Reservations pins MAC addresses (any common notation) to fixed IPs in Network.
+	Reservations map[string]net.IP
+	// Template supplies everything but YourIP and SubnetMask (router, DNS, boot file, ...).
+	// A zero LeaseTime defaults to one hour.
+	Template DHCPOffer
+}
+
+// PoolAllocator is a ready-made DHCPAllocator managing one or more subnets. It honors MAC
+// reservations, prefers the address a client held before, and reuses expired leases once
+// the never-used part of a range runs out. Addresses offered on DISCOVER are held briefly
+// so concurrent clients are not offered the same one.
+type PoolAllocator struct {
+	// OfferHold is how long an offered address stays reserved awaiting REQUEST (0 = 1m).
+	OfferHold time.Duration
+	// Quarantine is how long an address declined by a client is withheld (0 = 1h).
+	Quarantine time.Duration
+
+	mu       sync.Mutex
+	subnets  []*poolSubnet
+	byMAC    map[string]*DHCPLease
+	byIP     map[uint32]*DHCPLease
+	declined map[uint32]time.Time
+	now      func() time.Time
+}
+
+type poolSubnet struct {
+	DHCPSubnet
+	start, end   uint32
+	excluded     map[uint32]struct{}
+	reservations map[string]uint32
+	reservedIPs  map[uint32]string
+}
+
+// NewPoolAllocator validates the subnets and returns an allocator ready for use as
+// Options.DHCPAllocator. Requests are matched to a subnet by relay address (giaddr), then
+// by the client's current or requested address, falling back to the first subnet.
+func NewPoolAllocator(subnets ...DHCPSubnet) (*PoolAllocator, error) {
+	if len(subnets) == 0 {
+		return nil, errors.New("pool allocator needs at least one subnet")
+	}
+
+	p := &PoolAllocator{
+		byMAC:    make(map[string]*DHCPLease),
+		byIP:     make(map[uint32]*DHCPLease),
+		declined: make(map[uint32]time.Time),
+		now:      time.Now,
+	}
+
+	for i, subnet := range subnets {
+		ps, err := newPoolSubnet(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("subnet %d: %w", i, err)
+		}
+		p.subnets = append(p.subnets, ps)
+	}
+
+	return p, nil
+}
+
+func newPoolSubnet(subnet DHCPSubnet) (*poolSubnet, error) {
+	if subnet.Network == nil || subnet.Network.IP.To4() == nil {
+		return nil, errors.New("network must be an IPv4 prefix")
+	}
+
+	network := ipToUint32(subnet.Network.IP.Mask(subnet.Network.Mask))
+	ones, bits := subnet.Network.Mask.Size()
+	if bits != 32 {
+		return nil, errors.New("network must have an IPv4 mask")
+	}
+	broadcast := network | ^uint32(0)>>uint(ones)
+
+	ps := &poolSubnet{
+		DHCPSubnet:   subnet,
+		start:        network + 1,
+		end:          broadcast - 1,
+		excluded:     make(map[uint32]struct{}),
+		reservations: make(map[string]uint32),
+		reservedIPs:  make(map[uint32]string),
+	}
+	if ones >= 31 {
+		ps.start, ps.end = network, broadcast
+	}
+
+	if subnet.RangeStart != nil {
+		ps.start = ipToUint32(subnet.RangeStart)
+	}
+	if subnet.RangeEnd != nil {
+		ps.end = ipToUint32(subnet.RangeEnd)
+	}
+	if !ps.contains(ps.start) || !ps.contains(ps.end) || ps.start > ps.end {
+		return nil, fmt.Errorf("range %s-%s is not inside %s", uint32ToIP(ps.start), uint32ToIP(ps.end), subnet.Network)
+	}
+
+	for _, ip := range subnet.Exclude {
+		ps.excluded[ipToUint32(ip)] = struct{}{}
+	}
+
+	for mac, ip := range subnet.Reservations {
+		norm, ok := normalizeMACString(mac)
+		if !ok {
+			return nil, fmt.Errorf("invalid reservation MAC %q", mac)
+		}
+		addr := ipToUint32(ip)
+		if !ps.contains(addr) {
+			return nil, fmt.Errorf("reservation %s for %s is not inside %s", ip, mac, subnet.Network)
+		}
+		ps.reservations[norm] = addr
+		ps.reservedIPs[addr] = norm
+	}
+
+	return ps, nil
+}
+
+func (ps *poolSubnet) contains(ip uint32) bool {
+	return ps.Network.Contains(uint32ToIP(ip))
+}
+
+func (ps *poolSubnet) inRange(ip uint32) bool {
+	if ip < ps.start || ip > ps.end {
+		return false
+	}
+	_, excluded := ps.excluded[ip]
+	return !excluded
+}
+
+// Offer implements DHCPAllocator.
+func (p *PoolAllocator) Offer(req *DHCPRequest) (*DHCPOffer, error) {
+	mac, ok := normalizeMACString(req.ClientMAC.String())
+	if !ok {
+		return nil, fmt.Errorf("invalid client MAC %q", req.ClientMAC)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// INFORM clients already have an address; they only want the subnet's configuration.
+	if req.MessageType == dhcpv4.MessageTypeInform {
+		subnet, err := p.subnetFor(req)
+		if err != nil {
+			return nil, err
+		}
+		offer := subnet.Template
+		offer.Options = maps.Clone(offer.Options)
+		offer.SubnetMask = subnet.Network.Mask
+		return &offer, nil
+	}
+
+	now := p.now()
+	choose := p.choose
+	if req.MessageType == dhcpv4.MessageTypeRequest {
+		choose = p.confirm
+	}
+	subnet, ip, err := choose(req, mac, now)
+	if err != nil {
+		return nil, err
+	}
+
+	offer := subnet.Template
+	offer.Options = maps.Clone(offer.Options)
+	if offer.LeaseTime <= 0 {
+		offer.LeaseTime = defaultPoolLeaseTime
+	}
+	offer.YourIP = uint32ToIP(ip)
+	offer.SubnetMask = subnet.Network.Mask
+
+	hold := p.OfferHold
+	if hold <= 0 {
+		hold = defaultPoolOfferHold
+	}
+	expiry := now.Add(hold)
+	if req.MessageType == dhcpv4.MessageTypeRequest {
+		expiry = now.Add(offer.LeaseTime)
+	}
+	p.bind(mac, req.ClientMAC, ip, expiry)
+
+	return &offer, nil
+}
+
+// choose picks the subnet and address for a client: its reservation, then its previous
+// lease (in memory or from the lease store), then the address it asked for, then a
+// never-used address, then the longest expired lease.
+func (p *PoolAllocator) choose(req *DHCPRequest, mac string, now time.Time) (*poolSubnet, uint32, error) {
+	subnet, err := p.subnetFor(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Reservations win; unrelayed clients may be reserved on any subnet.
+	if ip, ok := subnet.reservations[mac]; ok {
+		return subnet, ip, nil
+	}
+	if !isSetIPv4(req.GatewayIP) {
+		for _, other := range p.subnets {
+			if ip, ok := other.reservations[mac]; ok {
+				return other, ip, nil
+			}
+		}
+	}
+
+	if lease, ok := p.byMAC[mac]; ok {
+		ip := ipToUint32(lease.IP)
+		if subnet.inRange(ip) && p.available(subnet, ip, mac, now) {
+			return subnet, ip, nil
+		}
+	}
+
+	var previous net.IP
+	if req.PreviousLease != nil {
+		previous = req.PreviousLease.IP
+	}
+	for _, candidate := range []net.IP{previous, req.CurrentIP, req.RequestedIP} {
+		if !isSetIPv4(candidate) {
+			continue
+		}
+		ip := ipToUint32(candidate)
+		if subnet.inRange(ip) && p.available(subnet, ip, mac, now) {
+			return subnet, ip, nil
+		}
+	}
+
+	var (
+		oldest   *DHCPLease
+		oldestIP uint32
+	)
+	for ip := subnet.start; ; ip++ {
+		if _, reserved := subnet.reservedIPs[ip]; subnet.inRange(ip) && !reserved && !p.quarantined(ip, now) {
+			lease, leased := p.byIP[ip]
+			if !leased {
+				return subnet, ip, nil
+			}
+			if lease.Expiry.Before(now) && (oldest == nil || lease.Expiry.Before(oldest.Expiry)) {
+				oldest, oldestIP = lease, ip
+			}
+		}
+		if ip == subnet.end {
+			break
+		}
+	}
+
+	if oldest == nil {
+		return nil, 0, ErrPoolExhausted
+	}
+	return subnet, oldestIP, nil
+}
+
+// confirm checks the address a REQUEST asks for: option 50 when SELECTING or in
+// INIT-REBOOT, ciaddr when RENEWING or REBINDING. An address this client could not be
+// offered (wrong subnet, reserved or leased to someone else, quarantined) is refused with
+// ErrDHCPNak, per RFC 2131 §4.3.2.
+func (p *PoolAllocator) confirm(req *DHCPRequest, mac string, now time.Time) (*poolSubnet, uint32, error) {
+	target := req.RequestedIP
+	if !isSetIPv4(target) {
+		target = req.CurrentIP
+	}
+	if !isSetIPv4(target) {
+		return p.choose(req, mac, now)
+	}
+
+	subnet, err := p.subnetFor(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !subnet.Network.Contains(target) {
+		return nil, 0, fmt.Errorf("%w: %s is not on %s", ErrDHCPNak, target, subnet.Network)
+	}
+
+	ip := ipToUint32(target)
+	if reserved, ok := subnet.reservations[mac]; ok && reserved != ip {
+		return nil, 0, fmt.Errorf("%w: %s is reserved %s", ErrDHCPNak, req.ClientMAC, uint32ToIP(reserved))
+	}
+	if owner, ok := subnet.reservedIPs[ip]; ok && owner == mac {
+		return subnet, ip, nil
+	}
+	if !subnet.inRange(ip) || !p.available(subnet, ip, mac, now) {
+		return nil, 0, fmt.Errorf("%w: %s is not available", ErrDHCPNak, target)
+	}
+	return subnet, ip, nil
+}
+
+// subnetFor matches a request to a subnet. Relayed requests must land on the relay's
+// subnet; otherwise the client's current or requested address decides, falling back to
+// the first subnet.
+func (p *PoolAllocator) subnetFor(req *DHCPRequest) (*poolSubnet, error) {
+	if isSetIPv4(req.GatewayIP) {
+		for _, subnet := range p.subnets {
+			if subnet.Network.Contains(req.GatewayIP) {
+				return subnet, nil
+			}
+		}
+		return nil, fmt.Errorf("no subnet configured for relay %s", req.GatewayIP)
+	}
+
+	for _, candidate := range []net.IP{req.CurrentIP, req.RequestedIP} {
+		if !isSetIPv4(candidate) {
+			continue
+		}
+		for _, subnet := range p.subnets {
+			if subnet.Network.Contains(candidate) {
+				return subnet, nil
+			}
+		}
+	}
+	return p.subnets[0], nil
+}
+
+func isSetIPv4(ip net.IP) bool {
+	return ip != nil && ip.To4() != nil && !ip.IsUnspecified()
+}
+
+// available reports whether ip can go to mac: not reserved for someone else, not
+// quarantined and not actively leased to another client.
+func (p *PoolAllocator) available(subnet *poolSubnet, ip uint32, mac string, now time.Time) bool {
+	if owner, reserved := subnet.reservedIPs[ip]; reserved && owner != mac {
+		return false
+	}
+	if p.quarantined(ip, now) {
+		return false
+	}
+	lease, leased := p.byIP[ip]
+	if !leased {
+		return true
+	}
+	owner, _ := normalizeMACString(lease.MAC.String())
+	return owner == mac || lease.Expiry.Before(now)
+}
+
+func (p *PoolAllocator) bind(mac string, hw net.HardwareAddr, ip uint32, expiry time.Time) {
+	if old, ok := p.byMAC[mac]; ok {
+		delete(p.byIP, ipToUint32(old.IP))
+	}
+	if old, ok := p.byIP[ip]; ok {
+		if owner, ok := normalizeMACString(old.MAC.String()); ok {
+			delete(p.byMAC, owner)
+		}
+	}
+
+	lease := &DHCPLease{
+		MAC:    append(net.HardwareAddr(nil), hw...),
+		IP:     uint32ToIP(ip),
+		Expiry: expiry,
+	}
+	p.byMAC[mac] = lease
+	p.byIP[ip] = lease
+}
+
+// quarantined reports whether ip was declined recently, forgetting stale entries.
+func (p *PoolAllocator) quarantined(ip uint32, now time.Time) bool {
+	until, ok := p.declined[ip]
+	if !ok {
+		return false
+	}
+	if !until.After(now) {
+		delete(p.declined, ip)
+		return false
+	}
+	return true
+}
+
+// Release implements DHCPReleaser. The lease is expired rather than dropped so the client
+// still gets the same address back if nobody else has taken it.
+func (p *PoolAllocator) Release(req *DHCPRequest) error {
+	mac, ok := normalizeMACString(req.ClientMAC.String())
+	if !ok {
+		return fmt.Errorf("invalid client MAC %q", req.ClientMAC)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lease, ok := p.byMAC[mac]
+	if !ok {
+		return nil
+	}
+	if isSetIPv4(req.CurrentIP) && !lease.IP.Equal(req.CurrentIP) {
+		return nil
+	}
+	lease.Expiry = p.now()
+	return nil
+}
+
+// Decline implements DHCPDecliner. The declined address (option 50, falling back to the
+// client's lease) is withheld from everyone for Quarantine, as something else is
+// answering on it.
+func (p *PoolAllocator) Decline(req *DHCPRequest) error {
+	mac, ok := normalizeMACString(req.ClientMAC.String())
+	if !ok {
+		return fmt.Errorf("invalid client MAC %q", req.ClientMAC)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	declined := req.RequestedIP
+	lease, leased := p.byMAC[mac]
+	if !isSetIPv4(declined) && leased {
+		declined = lease.IP
+	}
+	if !isSetIPv4(declined) {
+		return nil
+	}
+
+	ip := ipToUint32(declined)
+	if leased && ipToUint32(lease.IP) == ip {
+		delete(p.byMAC, mac)
+		delete(p.byIP, ip)
+	}
+
+	hold := p.Quarantine
+	if hold <= 0 {
+		hold = defaultPoolQuarantine
+	}
+	p.declined[ip] = p.now().Add(hold)
+	return nil
+}
+
+// RestoreLeases implements DHCPLeaseRestorer. Leases whose address falls outside every
+// configured range are skipped; a restored lease replaces any in-memory entry for the
+// same client or address.
+func (p *PoolAllocator) RestoreLeases(leases []DHCPLease) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, lease := range leases {
+		mac, ok := normalizeMACString(lease.MAC.String())
+		if !ok || !isSetIPv4(lease.IP) {
+			continue
+		}
+		ip := ipToUint32(lease.IP)
+		for _, subnet := range p.subnets {
+			if subnet.inRange(ip) {
+				p.bind(mac, lease.MAC, ip, lease.Expiry)
+				break
+			}
+		}
+	}
+}
+
+// Leases returns a snapshot of the lease table, including expired entries that have not
+// been reused yet, ordered by IP.
+func (p *PoolAllocator) Leases() []DHCPLease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]DHCPLease, 0, len(p.byIP))
+	for _, lease := range p.byIP {
+		out = append(out, *lease)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return ipToUint32(out[i].IP) < ipToUint32(out[j].IP)
+	})
+	return out
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	v4 := ip.To4()
+	if v4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v4)
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
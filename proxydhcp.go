@@ -0,0 +1,105 @@
+package tftp
+
+import (
+	"context"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// pxeVendorOptions is the option 43 payload of proxy replies: PXE_DISCOVERY_CONTROL (6)
+// with bit 3 set, telling the client to boot the file in the reply instead of running
+// boot server discovery.
+var pxeVendorOptions = []byte{6, 1, 8, 255}
+
+// startPXE listens for PXE boot server discovery (PXE 2.1 §2.2.4), the REQUEST a client
+// sends to port 4011 after a proxy offer.
+func (s *Server) startPXE(ctx context.Context) error {
+	if s.Options.DHCPAllocator == nil || s.Options.ListenAddrPXE == "" {
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", s.Options.ListenAddrPXE)
+	if err != nil {
+		return err
+	}
+
+	server, err := server4.NewServer("", addr, s.pxeHandler, server4.WithSummaryLogger())
+	if err != nil {
+		return err
+	}
+
+	s.pxeServer = server
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		_ = server.Serve()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	return nil
+}
+
+func (s *Server) pxeHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	if !s.dhcpMACAllowed(m.ClientHWAddr) {
+		return
+	}
+
+	req := newDHCPRequest(m)
+	if !req.IsPXE() {
+		return
+	}
+
+	switch req.MessageType {
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
+		// The client already has an address; answer it where it asked from.
+		if resp := s.proxyReply(m, req, dhcpv4.MessageTypeAck); resp != nil {
+			dhcpSend(conn, peer, m, resp)
+		}
+	}
+}
+
+// PXEHandler exposes the port 4011 handler for testing or embedding.
+func (s *Server) PXEHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	s.pxeHandler(conn, peer, m)
+}
+
+// proxyReply answers a PXE client with boot information only. The allocator still picks
+// the boot file and next server (and may override option 43); any address or network
+// configuration it returns is dropped, as that belongs to the network's own DHCP server.
+func (s *Server) proxyReply(m *dhcpv4.DHCPv4, req *DHCPRequest, msgType dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	offer, err := s.Options.DHCPAllocator.Offer(req)
+	if err != nil || offer == nil {
+		return nil
+	}
+
+	boot := &DHCPOffer{
+		BootFile:      offer.BootFile,
+		NextServer:    offer.NextServer,
+		ServerName:    offer.ServerName,
+		BootPlacement: offer.BootPlacement,
+	}
+
+	// Allocators may supply their own option 43, e.g. a PXE boot menu.
+	vendor := pxeVendorOptions
+	if value, ok := offer.Options[dhcpv4.OptionVendorSpecificInformation.Code()]; ok {
+		vendor = value
+	}
+
+	resp, err := s.dhcpReply(m, msgType, boot, s.dhcpServerIP(),
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")),
+		dhcpv4.WithGeneric(dhcpv4.OptionVendorSpecificInformation, vendor),
+		// PXE clients expect their machine identifier back (PXE 2.1 §2.5).
+		dhcpv4.WithOptionCopied(m, dhcpv4.OptionClientMachineIdentifier),
+	)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
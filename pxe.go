@@ -0,0 +1,200 @@
+package tftp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// PXEInterface is option 94, the client's network interface identifier (RFC 4578 §2.2).
+// Type 1 is UNDI; Major.Minor is its version (2.1 for PXE 2.1).
+type PXEInterface struct {
+	Type, Major, Minor uint8
+}
+
+// parsePXEOptions copies the PXE options of RFC 4578, the vendor and user classes and
+// iPXE's feature list into req.
+func parsePXEOptions(req *DHCPRequest, m *dhcpv4.DHCPv4) {
+	req.VendorClass = m.ClassIdentifier()
+	req.ClientArch = m.ClientArch()
+
+	if ndi := m.GetOneOption(dhcpv4.OptionClientNetworkInterfaceIdentifier); len(ndi) == 3 {
+		req.ClientInterface = &PXEInterface{Type: ndi[0], Major: ndi[1], Minor: ndi[2]}
+	}
+
+	req.UserClass = m.UserClass()
+	req.IPXEFeatures = parseIPXEFeatures(m.GetOneOption(dhcpv4.OptionEtherboot))
+
+	// Type 0 followed by a 16-byte UUID/GUID is the only format defined.
+	if guid := m.GetOneOption(dhcpv4.OptionClientMachineIdentifier); len(guid) == 17 && guid[0] == 0 {
+		u := guid[1:]
+		req.ClientUUID = fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+	}
+}
+
+// parseIPXEFeatures decodes option 175, a list of code/length/value sub-options iPXE uses
+// to advertise what it was built with. A truncated entry ends the list.
+func parseIPXEFeatures(raw []byte) map[uint8][]byte {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	features := make(map[uint8][]byte)
+	for len(raw) >= 2 {
+		code, size := raw[0], int(raw[1])
+		if len(raw) < 2+size {
+			break
+		}
+		features[code] = raw[2 : 2+size]
+		raw = raw[2+size:]
+	}
+	return features
+}
+
+// IsIPXE reports whether the client is iPXE rather than the NIC's firmware, judging by the
+// "iPXE" user class (option 77) or the presence of option 175.
+func (r *DHCPRequest) IsIPXE() bool {
+	for _, class := range r.UserClass {
+		if class == "iPXE" {
+			return true
+		}
+	}
+	return len(r.IPXEFeatures) > 0
+}
+
+// WithIPXEChainload wraps next to break PXE→iPXE→PXE loops: firmware clients keep the boot
+// file next chose (typically the iPXE binary), while clients already running iPXE get
+// scriptURL as their boot file.
+func WithIPXEChainload(next DHCPAllocator, scriptURL string) DHCPAllocator {
+	return &offerWrapper{next: next, offer: func(req *DHCPRequest) (*DHCPOffer, error) {
+		offer, err := next.Offer(req)
+		if err != nil || offer == nil {
+			return offer, err
+		}
+		if req.IsIPXE() {
+			offer.BootFile = scriptURL
+		}
+		return offer, nil
+	}}
+}
+
+// IsPXE reports whether the client identified itself as PXE firmware (option 60
+// "PXEClient..."). UEFI HTTP boot clients send "HTTPClient..." instead.
+func (r *DHCPRequest) IsPXE() bool {
+	return strings.HasPrefix(r.VendorClass, "PXEClient")
+}
+
+// IsHTTPBoot reports whether the client is UEFI HTTP boot firmware, which expects a URL as
+// its boot file.
+func (r *DHCPRequest) IsHTTPBoot() bool {
+	return strings.HasPrefix(r.VendorClass, "HTTPClient")
+}
+
+// Arch returns the first architecture the client listed in option 93, and false when it
+// sent none.
+func (r *DHCPRequest) Arch() (iana.Arch, bool) {
+	if len(r.ClientArch) == 0 {
+		return 0, false
+	}
+	return r.ClientArch[0], true
+}
+
+// BootFiles maps client architectures to boot files. Empty fields fall back to Default,
+// so only the architectures present in a fleet need filling in. HTTP fields are URLs.
+type BootFiles struct {
+	BIOS      string // x86 BIOS (arch 0), e.g. "pxelinux.0" or "undionly.kpxe"
+	UEFI32    string // x86 UEFI (arch 6)
+	UEFI64    string // x86-64 UEFI (arch 7 and 9), e.g. "ipxe.efi"
+	ARM64     string // ARM64 UEFI (arch 11)
+	HTTP64    string // x86-64 UEFI HTTP boot (arch 16)
+	HTTPARM64 string // ARM64 UEFI HTTP boot (arch 19)
+
+	// Arch overrides or extends the fields above for any architecture.
+	Arch map[iana.Arch]string
+	// Default is used for clients without option 93 or with an unmapped architecture.
+	Default string
+}
+
+// For returns the boot file for req, or Default.
+func (b BootFiles) For(req *DHCPRequest) string {
+	arch, ok := req.Arch()
+	if !ok {
+		return b.Default
+	}
+
+	if file, ok := b.Arch[arch]; ok && file != "" {
+		return file
+	}
+
+	var file string
+	switch arch {
+	case iana.INTEL_X86PC:
+		file = b.BIOS
+	case iana.EFI_IA32:
+		file = b.UEFI32
+	case iana.EFI_X86_64, iana.EFI_BC:
+		file = b.UEFI64
+	case iana.EFI_ARM64:
+		file = b.ARM64
+	case iana.EFI_X86_64_HTTP:
+		file = b.HTTP64
+	case iana.EFI_ARM64_HTTP:
+		file = b.HTTPARM64
+	}
+	if file == "" {
+		return b.Default
+	}
+	return file
+}
+
+// WithBootFiles wraps next so every offer's BootFile is chosen by files.For. Offers for
+// clients that map to an empty boot file keep whatever next set. UEFI HTTP boot clients
+// also get option 60 "HTTPClient", without which firmware ignores the boot URI.
+func WithBootFiles(next DHCPAllocator, files BootFiles) DHCPAllocator {
+	return &offerWrapper{next: next, offer: func(req *DHCPRequest) (*DHCPOffer, error) {
+		offer, err := next.Offer(req)
+		if err != nil || offer == nil {
+			return offer, err
+		}
+		if file := files.For(req); file != "" {
+			offer.BootFile = file
+		}
+		if req.IsHTTPBoot() {
+			offer.SetOption(dhcpv4.OptionClassIdentifier.Code(), []byte("HTTPClient"))
+		}
+		return offer, nil
+	}}
+}
+
+// offerWrapper replaces next's Offer and forwards the optional allocator extensions, so
+// wrapping a pool keeps its RELEASE, DECLINE and lease restore handling.
+type offerWrapper struct {
+	next  DHCPAllocator
+	offer DHCPAllocatorFunc
+}
+
+func (w *offerWrapper) Offer(req *DHCPRequest) (*DHCPOffer, error) {
+	return w.offer(req)
+}
+
+func (w *offerWrapper) Release(req *DHCPRequest) error {
+	if releaser, ok := w.next.(DHCPReleaser); ok {
+		return releaser.Release(req)
+	}
+	return nil
+}
+
+func (w *offerWrapper) Decline(req *DHCPRequest) error {
+	if decliner, ok := w.next.(DHCPDecliner); ok {
+		return decliner.Decline(req)
+	}
+	return nil
+}
+
+func (w *offerWrapper) RestoreLeases(leases []DHCPLease) {
+	if restorer, ok := w.next.(DHCPLeaseRestorer); ok {
+		restorer.RestoreLeases(leases)
+	}
+}
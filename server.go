@@ -4,14 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
 
-var errNoGetterConfigured = errors.New("no getter configured")
+var (
+	errNoGetterConfigured = errors.New("no getter configured")
+	errNoPutterConfigured = errors.New("no putter configured")
+)
 
 // NewServer configures a PXE helper with both TFTP and HTTP frontends.
 func NewServer(options Options) (*Server, error) {
@@ -19,6 +25,7 @@ func NewServer(options Options) (*Server, error) {
 		Options:     options,
 		QuitChannel: make(chan struct{}),
 		getter:      options.Getter,
+		putter:      options.Putter,
 	}
 
 	server.SetAllowedDHCPMACs(options.AllowedDHCPMACs)
@@ -33,6 +40,13 @@ func (s *Server) SetGetter(getter Getter) {
 	s.getter = getter
 }
 
+// SetPutter swaps the active putter at runtime; nil rejects TFTP write requests.
+func (s *Server) SetPutter(putter Putter) {
+	s.putterMu.Lock()
+	defer s.putterMu.Unlock()
+	s.putter = putter
+}
+
 // SetAllowedDHCPMACs replaces the DHCP allowlist (empty = allow all).
 func (s *Server) SetAllowedDHCPMACs(macs []string) {
 	s.dhcpMACMu.Lock()
@@ -53,6 +67,64 @@ func (s *Server) Get(getType GetType, ctx *Context) ([]byte, error) {
 	return getter.Get(getType, ctx)
 }
 
+// GetStream opens content as an Artifact, using the getter's StreamGetter implementation
+// when it has one and wrapping the []byte from Get otherwise.
+func (s *Server) GetStream(getType GetType, ctx *Context) (*Artifact, error) {
+	s.getterMu.RLock()
+	getter := s.getter
+	s.getterMu.RUnlock()
+
+	if getter == nil {
+		return nil, errNoGetterConfigured
+	}
+
+	if streamer, ok := getter.(StreamGetter); ok {
+		artifact, err := streamer.GetStream(getType, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if artifact == nil || artifact.Content == nil {
+			return NewArtifact(nil), nil
+		}
+		return artifact, nil
+	}
+
+	content, err := getter.Get(getType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewArtifact(content), nil
+}
+
+// Put proxies to the configured putter while safely handling the nil case.
+func (s *Server) Put(getType GetType, ctx *Context, reader io.Reader) error {
+	s.putterMu.RLock()
+	putter := s.putter
+	s.putterMu.RUnlock()
+
+	if putter == nil {
+		return errNoPutterConfigured
+	}
+
+	return putter.Put(getType, ctx, reader)
+}
+
+// sizeHint asks the getter for a file size without fetching content. hinted is false when
+// the getter does not implement Sizer.
+func (s *Server) sizeHint(getType GetType, ctx *Context) (size int64, hinted bool, err error) {
+	s.getterMu.RLock()
+	getter := s.getter
+	s.getterMu.RUnlock()
+
+	sizer, ok := getter.(Sizer)
+	if !ok {
+		return 0, false, nil
+	}
+
+	size, err = sizer.Size(getType, ctx)
+	return size, true, err
+}
+
 // Start brings up both TFTP and HTTP listeners. It returns an error if either listener
 // cannot bind.
 func (s *Server) Start() error {
@@ -79,6 +151,16 @@ func (s *Server) Start() error {
 		return fmt.Errorf("start dhcp: %w", err)
 	}
 
+	if err := s.startPXE(ctx); err != nil {
+		cancel()
+		return fmt.Errorf("start pxe: %w", err)
+	}
+
+	if err := s.startDHCPv6(ctx); err != nil {
+		cancel()
+		return fmt.Errorf("start dhcpv6: %w", err)
+	}
+
 	return nil
 }
 
@@ -102,6 +184,14 @@ func (s *Server) Stop() {
 		_ = s.dhcpServer.Close()
 	}
 
+	if s.pxeServer != nil {
+		_ = s.pxeServer.Close()
+	}
+
+	if s.dhcpv6Server != nil {
+		_ = s.dhcpv6Server.Close()
+	}
+
 	if s.httpServer != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -116,12 +206,14 @@ func (s *Server) startTFTP(ctx context.Context) error {
 		return nil
 	}
 
-	addr, err := net.ResolveUDPAddr("udp4", s.Options.ListenAddrTFTP)
+	network := selectUDPNetwork(s.Options.ListenAddrTFTP)
+
+	addr, err := net.ResolveUDPAddr(network, s.Options.ListenAddrTFTP)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.ListenUDP("udp4", addr)
+	conn, err := net.ListenUDP(network, addr)
 	if err != nil {
 		return err
 	}
@@ -147,7 +239,12 @@ func (s *Server) startTFTP(ctx context.Context) error {
 						continue
 					}
 				}
-				continue
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					continue
+				}
 			}
 
 			payload := append([]byte(nil), buf[:n]...)
@@ -163,41 +260,204 @@ func (s *Server) handleTFTPRequest(ctx context.Context, conn *net.UDPConn, clien
 		return
 	}
 
-	if payload[1] != OPCODE_RRQ {
-		_ = sendErrorTFTP(conn, clientAddr, 4, "Unsupported operation")
-		return
+	// Each transfer gets its own context so getters and putters see it end with the
+	// transfer as well as on Stop.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	switch payload[1] {
+	case OPCODE_RRQ:
+		s.handleReadTFTP(ctx, conn, clientAddr, payload)
+	case OPCODE_WRQ:
+		s.handleWriteTFTP(ctx, conn, clientAddr, payload)
+	default:
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_ILLEGAL_OPERATION, "Unsupported operation")
 	}
+}
 
-	filename, mode, err := ParseRRQRequestTFTP(payload)
+func (s *Server) handleReadTFTP(ctx context.Context, conn *net.UDPConn, clientAddr *net.UDPAddr, payload []byte) {
+	filename, mode, requested, err := ParseRequestTFTP(payload)
 	if err != nil {
-		_ = sendErrorTFTP(conn, clientAddr, 0, "Invalid request")
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_UNDEFINED, "Invalid request")
+		return
+	}
+
+	mode, ok := normalizeModeTFTP(mode)
+	if !ok {
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_ILLEGAL_OPERATION, "Unsupported transfer mode")
 		return
 	}
 
-	_ = mode // reserved for future use; currently accepts anything
+	transfer, oack := s.negotiateTFTP(requested)
+	transfer.Mode = mode
 
 	from := &Requestor{}
 	ip := clientAddr.IP.String()
 	from.IPAddress = &ip
 
-	content, err := s.Get(GetTypeTFTP, &Context{
+	getCtx := &Context{
 		GetType:  GetTypeTFTP,
 		Filename: filename,
 		From:     from,
-	})
+		Transfer: &transfer,
+		ctx:      ctx,
+	}
+
+	// tsize (RFC 2349) is answered from a Sizer when available so size probes never
+	// open the file; otherwise the artifact itself is opened up front.
+	_, wantSize := requested[tftpOptionTransferSize]
+	var (
+		size   int64
+		hinted bool
+	)
+	// A Sizer reports raw bytes, which is not what a netascii client receives.
+	if wantSize && mode != MODE_NETASCII {
+		if size, hinted, err = s.sizeHint(GetTypeTFTP, getCtx); err != nil {
+			s.sendErrorTFTP(conn, clientAddr, err)
+			return
+		}
+	}
+
+	var artifact *Artifact
+	if !hinted {
+		if artifact, err = s.GetStream(GetTypeTFTP, getCtx); err != nil {
+			s.sendErrorTFTP(conn, clientAddr, err)
+			return
+		}
+		defer artifact.Close()
+		size = artifact.Size
+
+		if wantSize && mode == MODE_NETASCII {
+			if size, err = netasciiSize(artifact.Content); err != nil {
+				s.sendErrorTFTP(conn, clientAddr, err)
+				return
+			}
+		}
+	}
+
+	if wantSize && size >= 0 {
+		transfer.TransferSize = size
+		oack = append(oack, tftpOptionTransferSize, strconv.FormatInt(size, 10))
+	}
+
+	dataConn, err := net.ListenUDP(dataNetworkTFTP(clientAddr), nil)
 	if err != nil {
-		_ = sendErrorTFTP(conn, clientAddr, 1, err.Error())
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_UNDEFINED, "unable to open data socket")
+		return
+	}
+	defer dataConn.Close()
+
+	if len(oack) > 0 {
+		// A client that only probed for tsize aborts here with error 8.
+		if err := SendOACKTFTP(ctx, dataConn, clientAddr, oack, transfer); err != nil {
+			return
+		}
+	}
+
+	if hinted {
+		if artifact, err = s.GetStream(GetTypeTFTP, getCtx); err != nil {
+			s.sendErrorTFTP(dataConn, clientAddr, err)
+			return
+		}
+		defer artifact.Close()
+	}
+
+	_ = SendStreamTFTP(ctx, dataConn, clientAddr, artifact.Content, transfer)
+}
+
+func (s *Server) handleWriteTFTP(ctx context.Context, conn *net.UDPConn, clientAddr *net.UDPAddr, payload []byte) {
+	s.putterMu.RLock()
+	hasPutter := s.putter != nil
+	s.putterMu.RUnlock()
+
+	if !hasPutter {
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_ILLEGAL_OPERATION, "Unsupported operation")
 		return
 	}
 
-	dataConn, err := net.ListenUDP("udp4", nil)
+	filename, mode, requested, err := ParseRequestTFTP(payload)
 	if err != nil {
-		_ = sendErrorTFTP(conn, clientAddr, 0, "unable to open data socket")
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_UNDEFINED, "Invalid request")
+		return
+	}
+
+	mode, ok := normalizeModeTFTP(mode)
+	if !ok {
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_ILLEGAL_OPERATION, "Unsupported transfer mode")
+		return
+	}
+
+	transfer, oack := s.negotiateTFTP(requested)
+	transfer.Mode = mode
+
+	// On a WRQ, tsize announces the upload size so oversized files are refused up front.
+	if raw, ok := requested[tftpOptionTransferSize]; ok {
+		if size, err := strconv.ParseInt(raw, 10, 64); err == nil && size >= 0 {
+			if s.Options.MaxWriteSizeTFTP > 0 && size > s.Options.MaxWriteSizeTFTP {
+				_ = sendErrorTFTP(conn, clientAddr, ERROR_DISK_FULL, "Disk full or allocation exceeded")
+				return
+			}
+			transfer.TransferSize = size
+			oack = append(oack, tftpOptionTransferSize, raw)
+		}
+	}
+
+	from := &Requestor{}
+	ip := clientAddr.IP.String()
+	from.IPAddress = &ip
+
+	putCtx := &Context{
+		GetType:  GetTypeTFTP,
+		Filename: filename,
+		From:     from,
+		Transfer: &transfer,
+		ctx:      ctx,
+	}
+
+	dataConn, err := net.ListenUDP(dataNetworkTFTP(clientAddr), nil)
+	if err != nil {
+		_ = sendErrorTFTP(conn, clientAddr, ERROR_UNDEFINED, "unable to open data socket")
 		return
 	}
 	defer dataConn.Close()
 
-	_ = SendBufferTFTP(ctx, dataConn, clientAddr, content)
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := s.Put(GetTypeTFTP, putCtx, pr)
+		// Unblock the receiver if the putter stops reading early.
+		_ = pr.CloseWithError(err)
+		result <- err
+	}()
+
+	first := []byte{0, OPCODE_ACK, 0, 0}
+	if len(oack) > 0 {
+		first = buildOACKTFTP(oack)
+	}
+
+	finish := func() error {
+		_ = pw.Close()
+		return <-result
+	}
+
+	fail := func(err error) {
+		s.sendErrorWithFallbackTFTP(dataConn, clientAddr, err, ERROR_UNDEFINED)
+	}
+
+	if err := receiveTFTP(ctx, dataConn, clientAddr, pw, first, transfer, s.Options.MaxWriteSizeTFTP, finish, fail); err != nil {
+		_ = pw.CloseWithError(err)
+	}
+}
+
+// sendErrorTFTP reports a getter or putter error to the client using the code that matches
+// its type (see tftpErrorFor). Unclassified errors keep the historical "file not found".
+func (s *Server) sendErrorTFTP(conn *net.UDPConn, addr *net.UDPAddr, err error) {
+	s.sendErrorWithFallbackTFTP(conn, addr, err, ERROR_FILE_NOT_FOUND)
+}
+
+func (s *Server) sendErrorWithFallbackTFTP(conn *net.UDPConn, addr *net.UDPAddr, err error, fallback int) {
+	code, msg := tftpErrorFor(err, fallback, s.Options.ExposeErrors)
+	_ = sendErrorTFTP(conn, addr, code, msg)
 }
 
 func (s *Server) startHTTP(ctx context.Context) error {
@@ -233,6 +493,58 @@ func (s *Server) startHTTP(ctx context.Context) error {
 	return nil
 }
 
+// bootContentTypes covers boot artifacts the system MIME table usually does not know.
+var bootContentTypes = map[string]string{
+	".ipxe":     "text/plain; charset=utf-8",
+	".cfg":      "text/plain; charset=utf-8",
+	".conf":     "text/plain; charset=utf-8",
+	".ks":       "text/plain; charset=utf-8",
+	".seed":     "text/plain; charset=utf-8",
+	".yaml":     "application/yaml",
+	".yml":      "application/yaml",
+	".iso":      "application/x-iso9660-image",
+	".efi":      "application/efi",
+	".kpxe":     "application/octet-stream",
+	".pxe":      "application/octet-stream",
+	".img":      "application/octet-stream",
+	".squashfs": "application/octet-stream",
+}
+
+// applyArtifactHeaders sets the response headers for an artifact. Without an explicit
+// ContentType the boot table and then the system MIME table are consulted by extension;
+// if both miss, Content-Type is left unset so http.ServeContent sniffs the content.
+func applyArtifactHeaders(h http.Header, artifact *Artifact, filename string) {
+	contentType := artifact.ContentType
+	if contentType == "" {
+		ext := strings.ToLower(path.Ext(filename))
+		if ct, ok := bootContentTypes[ext]; ok {
+			contentType = ct
+		} else if ext != "" {
+			contentType = mime.TypeByExtension(ext)
+		}
+	}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+
+	if etag := artifact.etag(); etag != "" {
+		h.Set("ETag", etag)
+	}
+	if artifact.CacheControl != "" {
+		h.Set("Cache-Control", artifact.CacheControl)
+	}
+	if artifact.ContentDisposition != "" {
+		h.Set("Content-Disposition", artifact.ContentDisposition)
+	}
+
+	for key, values := range artifact.Header {
+		h.Del(key)
+		for _, v := range values {
+			h.Add(key, v)
+		}
+	}
+}
+
 // selectHTTPNetwork picks an explicit network so IPv4 binds stay on IPv4-only sockets.
 func selectHTTPNetwork(addr string) string {
 	network := "tcp"
@@ -258,6 +570,45 @@ func selectHTTPNetwork(addr string) string {
 	return "tcp6"
 }
 
+// selectUDPNetwork picks the TFTP listener network like selectHTTPNetwork, except that
+// "[::]" listens dual-stack so IPv4 and IPv6 clients share one socket.
+func selectUDPNetwork(addr string) string {
+	network := "udp"
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return network
+	}
+
+	if host == "" {
+		return "udp4"
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return network
+	}
+
+	if ip.To4() != nil {
+		return "udp4"
+	}
+
+	if ip.IsUnspecified() {
+		return network
+	}
+
+	return "udp6"
+}
+
+// dataNetworkTFTP returns the network for a transfer's data socket, matching the client's
+// family. IPv4 clients of a dual-stack listener arrive as IPv4-mapped addresses.
+func dataNetworkTFTP(clientAddr *net.UDPAddr) string {
+	if clientAddr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
 // HTTPHandler returns the HTTP handler used for serving dynamic artifacts.
 func (s *Server) HTTPHandler() http.Handler {
 	mux := http.NewServeMux()
@@ -266,6 +617,12 @@ func (s *Server) HTTPHandler() http.Handler {
 }
 
 func (s *Server) httpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
 	filename := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
 	if filename == "" || filename == "." {
 		http.NotFound(w, r)
@@ -283,16 +640,31 @@ func (s *Server) httpHandler(w http.ResponseWriter, r *http.Request) {
 		req.MacAddress = &mac
 	}
 
-	content, err := s.Get(GetTypeHTTP, &Context{
+	artifact, err := s.GetStream(GetTypeHTTP, &Context{
 		GetType:  GetTypeHTTP,
 		Filename: filename,
 		From:     req,
+		ctx:      r.Context(),
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		var redirect *RedirectError
+		if errors.As(err, &redirect) {
+			http.Redirect(w, r, redirect.Location, http.StatusFound)
+			return
+		}
+
+		status := httpStatusFor(err)
+		msg := http.StatusText(status)
+		if s.Options.ExposeErrors {
+			msg = err.Error()
+		}
+		http.Error(w, msg, status)
 		return
 	}
+	defer artifact.Close()
+
+	applyArtifactHeaders(w.Header(), artifact, filename)
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	_, _ = w.Write(content)
+	// ServeContent handles HEAD, Range, If-Modified-Since and If-None-Match/If-Range.
+	http.ServeContent(w, r, path.Base(filename), artifact.ModTime, artifact.Content)
 }
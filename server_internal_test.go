@@ -25,3 +25,28 @@ func TestSelectHTTPNetwork(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectUDPNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		want string
+	}{
+		{name: "ipv4 unspecified", addr: ":69", want: "udp4"},
+		{name: "ipv4 all interfaces", addr: "0.0.0.0:69", want: "udp4"},
+		{name: "ipv4 loopback", addr: "127.0.0.1:6969", want: "udp4"},
+		{name: "ipv6 dual-stack", addr: "[::]:69", want: "udp"},
+		{name: "ipv6 loopback", addr: "[::1]:6969", want: "udp6"},
+		{name: "hostname", addr: "localhost:69", want: "udp"},
+		{name: "missing port", addr: "69", want: "udp"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectUDPNetwork(tt.addr); got != tt.want {
+				t.Fatalf("selectUDPNetwork(%q) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package tftp_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/opnlaas/tftp"
+)
+
+var dhcpv6ServerID = &dhcpv6.DUIDLL{
+	HWType:        iana.HWTypeEthernet,
+	LinkLayerAddr: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+}
+
+func newDHCPv6Server(t *testing.T, rapidCommit bool, seen *[]*tftp.DHCPv6Request) *tftp.Server {
+	t.Helper()
+
+	allocator := tftp.DHCPv6AllocatorFunc(func(req *tftp.DHCPv6Request) (*tftp.DHCPv6Offer, error) {
+		if seen != nil {
+			*seen = append(*seen, req)
+		}
+		return &tftp.DHCPv6Offer{
+			Address:        net.ParseIP("2001:db8::100"),
+			DNSServers:     []net.IP{net.ParseIP("2001:db8::53")},
+			BootFileURL:    "tftp://[2001:db8::1]/ipxe.efi",
+			BootFileParams: []string{"console=ttyS0"},
+		}, nil
+	})
+
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPv6Allocator:   allocator,
+		DHCPv6ServerID:    dhcpv6ServerID,
+		DHCPv6RapidCommit: rapidCommit,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	return srv
+}
+
+func dhcpv6Reply(t *testing.T, pc *recordingPacketConn) *dhcpv6.Message {
+	t.Helper()
+
+	if pc.writes != 1 {
+		t.Fatalf("expected one reply, got %d", pc.writes)
+	}
+	msg, err := dhcpv6.MessageFromBytes(pc.data)
+	if err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+	return msg
+}
+
+func checkDHCPv6Offer(t *testing.T, msg *dhcpv6.Message, iaid [4]byte) {
+	t.Helper()
+
+	if sid := msg.Options.ServerID(); sid == nil || !sid.Equal(dhcpv6ServerID) {
+		t.Fatalf("unexpected server ID %v", sid)
+	}
+	ia := msg.Options.OneIANA()
+	if ia == nil {
+		t.Fatalf("reply has no IA_NA")
+	}
+	if ia.IaId != iaid {
+		t.Fatalf("IAID = %x, want %x", ia.IaId, iaid)
+	}
+	addr := ia.Options.OneAddress()
+	if addr == nil || !addr.IPv6Addr.Equal(net.ParseIP("2001:db8::100")) {
+		t.Fatalf("unexpected IA address %v", addr)
+	}
+	if addr.PreferredLifetime != time.Hour || addr.ValidLifetime != 2*time.Hour {
+		t.Fatalf("unexpected lifetimes %v/%v", addr.PreferredLifetime, addr.ValidLifetime)
+	}
+	if dns := msg.Options.DNS(); len(dns) != 1 || !dns[0].Equal(net.ParseIP("2001:db8::53")) {
+		t.Fatalf("unexpected DNS servers %v", dns)
+	}
+	if url := msg.Options.BootFileURL(); url != "tftp://[2001:db8::1]/ipxe.efi" {
+		t.Fatalf("unexpected boot file URL %q", url)
+	}
+	if params := msg.Options.BootFileParam(); len(params) != 1 || params[0] != "console=ttyS0" {
+		t.Fatalf("unexpected boot file params %v", params)
+	}
+}
+
+func TestDHCPv6SolicitAdvertiseRequestReply(t *testing.T) {
+	var seen []*tftp.DHCPv6Request
+	srv := newDHCPv6Server(t, false, &seen)
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	solicit, err := dhcpv6.NewSolicit(hw, dhcpv6.WithArchType(iana.EFI_X86_64), dhcpv6.WithRapidCommit)
+	if err != nil {
+		t.Fatalf("NewSolicit failed: %v", err)
+	}
+
+	peer := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}
+	pc := &recordingPacketConn{}
+	srv.DHCPv6Handler(pc, peer, solicit)
+
+	// Rapid commit is off, so the client's rapid-commit option is ignored.
+	adv := dhcpv6Reply(t, pc)
+	if adv.Type() != dhcpv6.MessageTypeAdvertise {
+		t.Fatalf("expected ADVERTISE, got %s", adv.Type())
+	}
+	if adv.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+		t.Fatalf("ADVERTISE must not carry rapid commit")
+	}
+	if adv.TransactionID != solicit.TransactionID {
+		t.Fatalf("transaction ID not echoed")
+	}
+	if !pc.peer.(*net.UDPAddr).IP.Equal(peer.IP) {
+		t.Fatalf("reply sent to %v, want %v", pc.peer, peer)
+	}
+	checkDHCPv6Offer(t, adv, [4]byte{0x22, 0x33, 0x44, 0x55})
+
+	if len(seen) != 1 {
+		t.Fatalf("allocator called %d times", len(seen))
+	}
+	if got := seen[0]; got.ClientMAC.String() != hw.String() || len(got.ClientArch) != 1 || got.ClientArch[0] != iana.EFI_X86_64 || got.RapidCommit {
+		t.Fatalf("unexpected request %+v", got)
+	}
+
+	request, err := dhcpv6.NewRequestFromAdvertise(adv)
+	if err != nil {
+		t.Fatalf("NewRequestFromAdvertise failed: %v", err)
+	}
+	pc = &recordingPacketConn{}
+	srv.DHCPv6Handler(pc, peer, request)
+
+	reply := dhcpv6Reply(t, pc)
+	if reply.Type() != dhcpv6.MessageTypeReply {
+		t.Fatalf("expected REPLY, got %s", reply.Type())
+	}
+	checkDHCPv6Offer(t, reply, [4]byte{0x22, 0x33, 0x44, 0x55})
+	if got := seen[1]; len(got.RequestedIPs) != 1 || !got.RequestedIPs[0].Equal(net.ParseIP("2001:db8::100")) {
+		t.Fatalf("requested addresses = %v", got.RequestedIPs)
+	}
+}
+
+func TestDHCPv6RapidCommit(t *testing.T) {
+	var seen []*tftp.DHCPv6Request
+	srv := newDHCPv6Server(t, true, &seen)
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	solicit, err := dhcpv6.NewSolicit(hw, dhcpv6.WithRapidCommit)
+	if err != nil {
+		t.Fatalf("NewSolicit failed: %v", err)
+	}
+
+	pc := &recordingPacketConn{}
+	srv.DHCPv6Handler(pc, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}, solicit)
+
+	reply := dhcpv6Reply(t, pc)
+	if reply.Type() != dhcpv6.MessageTypeReply {
+		t.Fatalf("expected REPLY, got %s", reply.Type())
+	}
+	if reply.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+		t.Fatalf("REPLY must carry rapid commit")
+	}
+	checkDHCPv6Offer(t, reply, [4]byte{0x22, 0x33, 0x44, 0x55})
+	if !seen[0].RapidCommit {
+		t.Fatalf("allocator not told the Solicit is committed")
+	}
+
+	// Without the client's rapid-commit option the server still advertises.
+	solicit, err = dhcpv6.NewSolicit(hw)
+	if err != nil {
+		t.Fatalf("NewSolicit failed: %v", err)
+	}
+	pc = &recordingPacketConn{}
+	srv.DHCPv6Handler(pc, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}, solicit)
+	if msg := dhcpv6Reply(t, pc); msg.Type() != dhcpv6.MessageTypeAdvertise {
+		t.Fatalf("expected ADVERTISE, got %s", msg.Type())
+	}
+	if seen[1].RapidCommit {
+		t.Fatalf("allocator told an advertised Solicit is committed")
+	}
+}
+
+type releasingV6Allocator struct {
+	tftp.DHCPv6AllocatorFunc
+	released []*tftp.DHCPv6Request
+}
+
+func (a *releasingV6Allocator) Release(req *tftp.DHCPv6Request) error {
+	a.released = append(a.released, req)
+	return nil
+}
+
+func TestDHCPv6ReleaseNotifiesAllocator(t *testing.T) {
+	allocator := &releasingV6Allocator{
+		DHCPv6AllocatorFunc: func(req *tftp.DHCPv6Request) (*tftp.DHCPv6Offer, error) {
+			t.Errorf("Offer called for %s", req.MessageType)
+			return nil, nil
+		},
+	}
+	srv, err := tftp.NewServer(tftp.Options{DHCPv6Allocator: allocator, DHCPv6ServerID: dhcpv6ServerID})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	msg, err := dhcpv6.NewSolicit(hw, dhcpv6.WithServerID(dhcpv6ServerID))
+	if err != nil {
+		t.Fatalf("NewSolicit failed: %v", err)
+	}
+	msg.MessageType = dhcpv6.MessageTypeRelease
+	ia := msg.Options.OneIANA()
+	ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("2001:db8::100")})
+	msg.UpdateOption(ia)
+
+	pc := &recordingPacketConn{}
+	srv.DHCPv6Handler(pc, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}, msg)
+
+	reply := dhcpv6Reply(t, pc)
+	if status := reply.Options.Status(); reply.Type() != dhcpv6.MessageTypeReply || status == nil || status.StatusCode != iana.StatusSuccess {
+		t.Fatalf("expected REPLY with status Success, got %s %v", reply.Type(), status)
+	}
+	if len(allocator.released) != 1 {
+		t.Fatalf("expected one Release call, got %d", len(allocator.released))
+	}
+	if got := allocator.released[0].RequestedIPs; len(got) != 1 || !got[0].Equal(net.ParseIP("2001:db8::100")) {
+		t.Fatalf("released addresses = %v", got)
+	}
+}
+
+func TestDHCPv6IgnoresOtherServers(t *testing.T) {
+	srv := newDHCPv6Server(t, false, nil)
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	other := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}}
+
+	for _, msgType := range []dhcpv6.MessageType{dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew} {
+		msg, err := dhcpv6.NewSolicit(hw, dhcpv6.WithServerID(other))
+		if err != nil {
+			t.Fatalf("NewSolicit failed: %v", err)
+		}
+		msg.MessageType = msgType
+		pc := &recordingPacketConn{}
+		srv.DHCPv6Handler(pc, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}, msg)
+		if pc.writes != 0 {
+			t.Fatalf("%s for another server was answered", msgType)
+		}
+	}
+}
+
+func TestDHCPv6RelayedSolicit(t *testing.T) {
+	var seen []*tftp.DHCPv6Request
+	srv := newDHCPv6Server(t, false, &seen)
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	solicit, err := dhcpv6.NewSolicit(hw)
+	if err != nil {
+		t.Fatalf("NewSolicit failed: %v", err)
+	}
+	link := net.ParseIP("2001:db8:1::1")
+	relay, err := dhcpv6.EncapsulateRelay(solicit, dhcpv6.MessageTypeRelayForward, link, net.ParseIP("fe80::1"))
+	if err != nil {
+		t.Fatalf("EncapsulateRelay failed: %v", err)
+	}
+
+	pc := &recordingPacketConn{}
+	srv.DHCPv6Handler(pc, &net.UDPAddr{IP: net.ParseIP("2001:db8:1::1"), Port: 547}, relay)
+
+	if pc.writes != 1 {
+		t.Fatalf("expected one reply, got %d", pc.writes)
+	}
+	resp, err := dhcpv6.FromBytes(pc.data)
+	if err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+	if resp.Type() != dhcpv6.MessageTypeRelayReply {
+		t.Fatalf("expected RELAY-REPL, got %s", resp.Type())
+	}
+	inner, err := resp.GetInnerMessage()
+	if err != nil {
+		t.Fatalf("GetInnerMessage failed: %v", err)
+	}
+	if inner.Type() != dhcpv6.MessageTypeAdvertise {
+		t.Fatalf("expected ADVERTISE inside relay, got %s", inner.Type())
+	}
+	checkDHCPv6Offer(t, inner, [4]byte{0x22, 0x33, 0x44, 0x55})
+
+	if len(seen) != 1 || !seen[0].LinkAddr.Equal(link) {
+		t.Fatalf("allocator did not see relay link address")
+	}
+}
@@ -1,8 +1,11 @@
 package tftp_test
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -97,3 +100,456 @@ func TestDHCPAllowlistAllowsKnownMAC(t *testing.T) {
 		t.Fatalf("expected response payload to be recorded")
 	}
 }
+
+type freeingAllocator struct {
+	tftp.DHCPAllocatorFunc
+	released, declined int
+}
+
+func (a *freeingAllocator) Release(req *tftp.DHCPRequest) error {
+	a.released++
+	return nil
+}
+
+func (a *freeingAllocator) Decline(req *tftp.DHCPRequest) error {
+	a.declined++
+	return nil
+}
+
+func TestDHCPHandlerMessageTypes(t *testing.T) {
+	var offers int
+	allocator := &freeingAllocator{
+		DHCPAllocatorFunc: func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+			offers++
+			return &tftp.DHCPOffer{
+				YourIP:     net.IPv4(192, 0, 2, 100),
+				SubnetMask: net.IPv4Mask(255, 255, 255, 0),
+				LeaseTime:  time.Hour,
+			}, nil
+		},
+	}
+
+	srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: allocator})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 68}
+	send := func(mt dhcpv4.MessageType) *recordingPacketConn {
+		t.Helper()
+		m, err := dhcpv4.New(dhcpv4.WithHwAddr(hw), dhcpv4.WithMessageType(mt))
+		if err != nil {
+			t.Fatalf("build %s: %v", mt, err)
+		}
+		m.ClientIPAddr = net.IPv4(192, 0, 2, 100)
+		pc := &recordingPacketConn{}
+		srv.DHCPHandler(pc, peer, m)
+		return pc
+	}
+
+	for _, mt := range []dhcpv4.MessageType{dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline, dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck} {
+		if pc := send(mt); pc.writes != 0 {
+			t.Fatalf("expected no reply to %s, got %d writes", mt, pc.writes)
+		}
+	}
+	if allocator.released != 1 || allocator.declined != 1 || offers != 0 {
+		t.Fatalf("unexpected allocator calls: released=%d declined=%d offers=%d", allocator.released, allocator.declined, offers)
+	}
+
+	pc := send(dhcpv4.MessageTypeInform)
+	resp, err := dhcpv4.FromBytes(pc.data)
+	if err != nil {
+		t.Fatalf("failed to parse INFORM reply: %v", err)
+	}
+	if resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK for INFORM, got %s", resp.MessageType())
+	}
+	if !resp.YourIPAddr.IsUnspecified() || resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+		t.Fatalf("INFORM reply must not assign an address: yiaddr=%s lease=%v", resp.YourIPAddr, resp.IPAddressLeaseTime(0))
+	}
+	if resp.SubnetMask().String() != "ffffff00" {
+		t.Fatalf("expected configuration in INFORM reply, got mask %s", resp.SubnetMask())
+	}
+}
+
+func TestDHCPHandlerNaksAndIgnoresOtherServers(t *testing.T) {
+	allocator := tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		if !req.RequestedIP.Equal(net.IPv4(192, 0, 2, 100)) {
+			return nil, fmt.Errorf("stale lease: %w", tftp.ErrDHCPNak)
+		}
+		return &tftp.DHCPOffer{YourIP: req.RequestedIP}, nil
+	})
+
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPAllocator: allocator,
+		DHCPServerIP:  net.IPv4(192, 0, 2, 1),
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	send := func(requested net.IP, modifiers ...dhcpv4.Modifier) *recordingPacketConn {
+		t.Helper()
+		modifiers = append([]dhcpv4.Modifier{
+			dhcpv4.WithHwAddr(hw),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(requested)),
+		}, modifiers...)
+		m, err := dhcpv4.New(modifiers...)
+		if err != nil {
+			t.Fatalf("build REQUEST: %v", err)
+		}
+		pc := &recordingPacketConn{}
+		srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, m)
+		return pc
+	}
+
+	pc := send(net.IPv4(192, 0, 2, 55))
+	resp, err := dhcpv4.FromBytes(pc.data)
+	if err != nil {
+		t.Fatalf("failed to parse reply: %v", err)
+	}
+	if resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("expected NAK, got %s", resp.MessageType())
+	}
+	if !resp.YourIPAddr.IsUnspecified() || !resp.ServerIdentifier().Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("unexpected NAK contents: yiaddr=%s server=%s", resp.YourIPAddr, resp.ServerIdentifier())
+	}
+
+	if pc := send(net.IPv4(192, 0, 2, 55), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 254)))); pc.writes != 0 {
+		t.Fatalf("expected REQUEST for another server to be ignored, got %d writes", pc.writes)
+	}
+
+	pc = send(net.IPv4(192, 0, 2, 100), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 1))))
+	if resp, err := dhcpv4.FromBytes(pc.data); err != nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK for REQUEST naming this server, got %v, %v", resp, err)
+	}
+}
+
+func TestDHCPBootHeaderFields(t *testing.T) {
+	longFile := "http://192.0.2.5/" + strings.Repeat("x", 120) + "/ipxe.efi"
+	cases := []struct {
+		name                 string
+		offer                tftp.DHCPOffer
+		wantSname, wantFile  string
+		wantOpt66, wantOpt67 string
+		wantSiaddr           net.IP
+	}{
+		{
+			name:       "both by default",
+			offer:      tftp.DHCPOffer{NextServer: net.IPv4(192, 0, 2, 5), BootFile: "pxelinux.0"},
+			wantSname:  "192.0.2.5",
+			wantFile:   "pxelinux.0",
+			wantOpt66:  "192.0.2.5",
+			wantOpt67:  "pxelinux.0",
+			wantSiaddr: net.IPv4(192, 0, 2, 5),
+		},
+		{
+			name: "header only",
+			offer: tftp.DHCPOffer{
+				NextServer:    net.IPv4(192, 0, 2, 5),
+				ServerName:    "boot.example",
+				BootFile:      "pxelinux.0",
+				BootPlacement: tftp.BootPlacementHeader,
+			},
+			wantSname:  "boot.example",
+			wantFile:   "pxelinux.0",
+			wantSiaddr: net.IPv4(192, 0, 2, 5),
+		},
+		{
+			name: "options only",
+			offer: tftp.DHCPOffer{
+				NextServer:    net.IPv4(192, 0, 2, 5),
+				BootFile:      "pxelinux.0",
+				BootPlacement: tftp.BootPlacementOptions,
+			},
+			wantOpt66:  "192.0.2.5",
+			wantOpt67:  "pxelinux.0",
+			wantSiaddr: net.IPv4(192, 0, 2, 5),
+		},
+		{
+			name:       "long name falls back to option",
+			offer:      tftp.DHCPOffer{BootFile: longFile, BootPlacement: tftp.BootPlacementHeader},
+			wantOpt67:  longFile,
+			wantSiaddr: net.IPv4zero,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			offer := tc.offer
+			offer.YourIP = net.IPv4(192, 0, 2, 100)
+			srv, err := tftp.NewServer(tftp.Options{
+				DHCPAllocator: tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+					return &offer, nil
+				}),
+			})
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+
+			req, _ := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+			pc := &recordingPacketConn{}
+			srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, req)
+
+			resp, err := dhcpv4.FromBytes(pc.data)
+			if err != nil {
+				t.Fatalf("failed to parse reply: %v", err)
+			}
+			if !resp.ServerIPAddr.Equal(tc.wantSiaddr) {
+				t.Errorf("siaddr = %s, want %s", resp.ServerIPAddr, tc.wantSiaddr)
+			}
+			if resp.ServerHostName != tc.wantSname || resp.BootFileName != tc.wantFile {
+				t.Errorf("header sname/file = %q/%q, want %q/%q", resp.ServerHostName, resp.BootFileName, tc.wantSname, tc.wantFile)
+			}
+			if resp.TFTPServerName() != tc.wantOpt66 || resp.BootFileNameOption() != tc.wantOpt67 {
+				t.Errorf("options 66/67 = %q/%q, want %q/%q", resp.TFTPServerName(), resp.BootFileNameOption(), tc.wantOpt66, tc.wantOpt67)
+			}
+		})
+	}
+}
+
+func TestDHCPOfferOptionPassthrough(t *testing.T) {
+	_, lab, _ := net.ParseCIDR("10.20.0.0/16")
+	_, def, _ := net.ParseCIDR("0.0.0.0/0")
+
+	offer := tftp.DHCPOffer{
+		YourIP:     net.IPv4(192, 0, 2, 100),
+		DomainName: "ignored.example",
+	}
+	offer.SetNTPServers(net.IPv4(192, 0, 2, 123))
+	offer.SetStaticRoutes(
+		&dhcpv4.Route{Dest: lab, Router: net.IPv4(192, 0, 2, 254)},
+		&dhcpv4.Route{Dest: def, Router: net.IPv4(192, 0, 2, 1)},
+	)
+	offer.SetMTU(9000)
+	offer.SetHostName("node01")
+	offer.SetSearchDomains("lab.example", "example")
+	if err := offer.SetVendorOptions(map[uint8][]byte{10: {0, 'P', 'X', 'E'}, 6: {8}}); err != nil {
+		t.Fatalf("SetVendorOptions failed: %v", err)
+	}
+	if err := offer.SetVendorOptions(map[uint8][]byte{9: make([]byte, 256)}); err == nil {
+		t.Fatalf("expected oversized vendor sub-option to be rejected")
+	}
+	offer.SetOption(224, []byte("rack-7"))
+	offer.SetOption(dhcpv4.OptionDomainName.Code(), []byte("lab.example"))
+
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPAllocator: tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+			return &offer, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	req, _ := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		dhcpv4.WithRequestedOptions(
+			dhcpv4.OptionNTPServers, dhcpv4.OptionClasslessStaticRoute, dhcpv4.OptionInterfaceMTU,
+			dhcpv4.OptionHostName, dhcpv4.OptionDNSDomainSearchList, dhcpv4.GenericOptionCode(224),
+		))
+	pc := &recordingPacketConn{}
+	srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, req)
+
+	resp, err := dhcpv4.FromBytes(pc.data)
+	if err != nil {
+		t.Fatalf("failed to parse reply: %v", err)
+	}
+
+	if ntp := resp.NTPServers(); len(ntp) != 1 || !ntp[0].Equal(net.IPv4(192, 0, 2, 123)) {
+		t.Errorf("unexpected NTP servers %v", ntp)
+	}
+	if routes := resp.ClasslessStaticRoute(); len(routes) != 2 || routes[0].Dest.String() != "10.20.0.0/16" {
+		t.Errorf("unexpected routes %v", routes)
+	}
+	if mtu := resp.GetOneOption(dhcpv4.OptionInterfaceMTU); !bytes.Equal(mtu, []byte{0x23, 0x28}) {
+		t.Errorf("unexpected MTU %x", mtu)
+	}
+	if resp.HostName() != "node01" {
+		t.Errorf("unexpected host name %q", resp.HostName())
+	}
+	if search := resp.DomainSearch(); search == nil || strings.Join(search.Labels, ",") != "lab.example,example" {
+		t.Errorf("unexpected search list %v", search)
+	}
+	if vendor := resp.GetOneOption(dhcpv4.OptionVendorSpecificInformation); !bytes.Equal(vendor, []byte{6, 1, 8, 10, 4, 0, 'P', 'X', 'E', 255}) {
+		t.Errorf("unexpected option 43 %x", vendor)
+	}
+	if site := resp.GetOneOption(dhcpv4.GenericOptionCode(224)); string(site) != "rack-7" {
+		t.Errorf("unexpected option 224 %q", site)
+	}
+	if resp.DomainName() != "lab.example" {
+		t.Errorf("expected Options to override DomainName, got %q", resp.DomainName())
+	}
+}
+
+func TestDHCPReplyDestination(t *testing.T) {
+	nak := false
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPAllocator: tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+			if nak {
+				return nil, tftp.ErrDHCPNak
+			}
+			return &tftp.DHCPOffer{YourIP: net.IPv4(192, 0, 2, 100)}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 77), Port: 68}
+	cases := []struct {
+		name      string
+		mt        dhcpv4.MessageType
+		nak       bool
+		modifiers []dhcpv4.Modifier
+		want      string
+	}{
+		{"relayed", dhcpv4.MessageTypeDiscover, false, []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1))}, "198.51.100.1:67"},
+		{"renewing", dhcpv4.MessageTypeRequest, false, []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 100))}, "192.0.2.100:68"},
+		{"broadcast flag", dhcpv4.MessageTypeDiscover, false, []dhcpv4.Modifier{dhcpv4.WithBroadcast(true)}, "255.255.255.255:68"},
+		{"unicast capable", dhcpv4.MessageTypeDiscover, false, nil, "192.0.2.77:68"},
+		{"nak", dhcpv4.MessageTypeRequest, true, []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 100))}, "255.255.255.255:68"},
+		{"relayed nak", dhcpv4.MessageTypeRequest, true, []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1))}, "198.51.100.1:67"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nak = tc.nak
+			m, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithHwAddr(hw), dhcpv4.WithMessageType(tc.mt)}, tc.modifiers...)...)
+			if err != nil {
+				t.Fatalf("build message: %v", err)
+			}
+
+			pc := &recordingPacketConn{}
+			srv.DHCPHandler(pc, source, m)
+			if pc.writes != 1 {
+				t.Fatalf("expected one reply, got %d", pc.writes)
+			}
+			if pc.peer.String() != tc.want {
+				t.Fatalf("reply sent to %s, want %s", pc.peer, tc.want)
+			}
+			if tc.nak && tc.name == "relayed nak" {
+				resp, _ := dhcpv4.FromBytes(pc.data)
+				if !resp.IsBroadcast() {
+					t.Fatalf("expected relayed NAK to ask the relay to broadcast")
+				}
+			}
+		})
+	}
+}
+
+func TestDHCPParameterRequestListAndMaxSize(t *testing.T) {
+	offer := tftp.DHCPOffer{
+		YourIP:     net.IPv4(192, 0, 2, 100),
+		SubnetMask: net.IPv4Mask(255, 255, 255, 0),
+		Router:     net.IPv4(192, 0, 2, 1),
+		DNSServers: []net.IP{net.IPv4(192, 0, 2, 53)},
+		DomainName: strings.Repeat("d", 200),
+		BootFile:   "pxelinux.0",
+	}
+	offer.SetHostName(strings.Repeat("h", 200))
+	offer.SetMTU(1500)
+
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPAllocator: tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+			o := offer
+			return &o, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	send := func(modifiers ...dhcpv4.Modifier) []byte {
+		t.Helper()
+		m, err := dhcpv4.New(append([]dhcpv4.Modifier{
+			dhcpv4.WithHwAddr(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+			dhcpv4.WithBroadcast(true),
+		}, modifiers...)...)
+		if err != nil {
+			t.Fatalf("build DISCOVER: %v", err)
+		}
+		pc := &recordingPacketConn{}
+		srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4zero, Port: 68}, m)
+		return pc.data
+	}
+
+	// Requested options in the client's order; unrequested MTU and host name left out.
+	raw := send(dhcpv4.WithRequestedOptions(dhcpv4.OptionDomainNameServer, dhcpv4.OptionRouter, dhcpv4.OptionDomainName))
+	var codes []uint8
+	for i := 240; i < len(raw) && raw[i] != 255; i += 2 + int(raw[i+1]) {
+		codes = append(codes, raw[i])
+	}
+	want := []uint8{53, 54, 6, 3, 15, 1, 67}
+	if !bytes.Equal(codes, want) {
+		t.Fatalf("option order %v, want %v", codes, want)
+	}
+
+	// Without option 57 everything requested must fit in 576 bytes, so something gives.
+	everything := dhcpv4.WithRequestedOptions(dhcpv4.OptionHostName, dhcpv4.OptionDomainName, dhcpv4.OptionInterfaceMTU)
+	if raw := send(everything); len(raw) > 548 {
+		t.Fatalf("reply of %d bytes exceeds the default limit", len(raw))
+	}
+
+	raw = send(everything, dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(1500)))
+	resp, err := dhcpv4.FromBytes(raw)
+	if err != nil {
+		t.Fatalf("failed to parse reply: %v", err)
+	}
+	if resp.HostName() != strings.Repeat("h", 200) || resp.DomainName() != strings.Repeat("d", 200) || resp.Options.Has(dhcpv4.OptionOptionOverload) {
+		t.Fatalf("expected a 1500-byte limit to fit every option without overload")
+	}
+}
+
+func TestDHCPRelayAgentInformation(t *testing.T) {
+	var seen *tftp.DHCPRequest
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPAllocator: tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+			seen = req
+			if req.MessageType == dhcpv4.MessageTypeRequest {
+				return nil, tftp.ErrDHCPNak
+			}
+			return &tftp.DHCPOffer{YourIP: net.IPv4(198, 51, 100, 20)}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	relay := dhcpv4.OptRelayAgentInfo(
+		dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("Gi1/0/12:vlan42")),
+		dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte{0x00, 0xaa, 0xbb, 0xcc, 0xdd, 0xee}),
+	)
+	for _, mt := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest} {
+		m, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}),
+			dhcpv4.WithMessageType(mt),
+			dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1)),
+			dhcpv4.WithOption(relay),
+		)
+		if err != nil {
+			t.Fatalf("build %s: %v", mt, err)
+		}
+
+		pc := &recordingPacketConn{}
+		srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 67}, m)
+
+		if seen.RelayInfo == nil || string(seen.RelayInfo.CircuitID) != "Gi1/0/12:vlan42" ||
+			!bytes.Equal(seen.RelayInfo.RemoteID, []byte{0x00, 0xaa, 0xbb, 0xcc, 0xdd, 0xee}) {
+			t.Fatalf("%s: unexpected relay info %#v", mt, seen.RelayInfo)
+		}
+		if pc.peer.String() != "198.51.100.1:67" {
+			t.Fatalf("%s: reply sent to %s, want the relay", mt, pc.peer)
+		}
+
+		// Option 82 is echoed verbatim as the last option.
+		want := append([]byte{82, byte(len(relay.Value.ToBytes()))}, relay.Value.ToBytes()...)
+		if !bytes.HasSuffix(bytes.TrimRight(pc.data, "\x00"), append(want, 255)) {
+			t.Fatalf("%s: expected option 82 echoed last", mt)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package tftp_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/opnlaas/tftp"
 )
@@ -54,6 +60,313 @@ func TestHTTPHandlerUsesGetter(t *testing.T) {
 	}
 }
 
+func TestHTTPHandlerStreamsArtifact(t *testing.T) {
+	content := strings.Repeat("iso9660", 1000)
+	getter := tftp.StreamGetterFunc(func(gt tftp.GetType, ctx *tftp.Context) (*tftp.Artifact, error) {
+		return &tftp.Artifact{Content: strings.NewReader(content), Size: int64(len(content))}, nil
+	})
+
+	s, err := tftp.NewServer(tftp.Options{Getter: getter})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/images/installer.iso", nil)
+	rr := httptest.NewRecorder()
+
+	s.HTTPHandler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status: got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Content-Length"); got != "7000" {
+		t.Fatalf("unexpected Content-Length: %q", got)
+	}
+	if rr.Body.String() != content {
+		t.Fatalf("unexpected body length %d", rr.Body.Len())
+	}
+}
+
+func TestHTTPHandlerPropagatesRequestContext(t *testing.T) {
+	getterErr := make(chan error, 1)
+	getter := tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+		select {
+		case <-ctx.Context().Done():
+			getterErr <- ctx.Context().Err()
+			return nil, ctx.Context().Err()
+		case <-time.After(5 * time.Second):
+			getterErr <- nil
+			return []byte("late"), nil
+		}
+	})
+
+	s, err := tftp.NewServer(tftp.Options{Getter: getter})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel() // client already went away
+
+	req := httptest.NewRequest(http.MethodGet, "/slow.img", nil).WithContext(reqCtx)
+	s.HTTPHandler().ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := <-getterErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected getter to observe cancellation, got %v", err)
+	}
+}
+
+func TestContextDefaultsToBackground(t *testing.T) {
+	ctx := &tftp.Context{}
+	if ctx.Context() == nil {
+		t.Fatalf("expected non-nil context")
+	}
+
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if got := ctx.WithContext(parent).Context(); got != parent {
+		t.Fatalf("WithContext did not attach context")
+	}
+	if ctx.Context() == parent {
+		t.Fatalf("WithContext must not modify the original")
+	}
+}
+
+func TestHTTPHandlerMapsGetterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{name: "not found", err: fmt.Errorf("lookup boot.ipxe: %w", tftp.ErrNotFound), status: http.StatusNotFound},
+		{name: "fs not exist", err: fs.ErrNotExist, status: http.StatusNotFound},
+		{name: "access denied", err: tftp.ErrAccessDenied, status: http.StatusForbidden},
+		{name: "unavailable", err: tftp.ErrUnavailable, status: http.StatusServiceUnavailable},
+		{name: "unclassified", err: errors.New("db password rejected"), status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tftp.NewServer(tftp.Options{
+				Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+					return nil, tt.err
+				}),
+			})
+			if err != nil {
+				t.Fatalf("failed to create server: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			s.HTTPHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/boot.ipxe", nil))
+
+			if rr.Code != tt.status {
+				t.Fatalf("unexpected status: got %d, want %d", rr.Code, tt.status)
+			}
+			if strings.Contains(rr.Body.String(), tt.err.Error()) {
+				t.Fatalf("error text leaked to client: %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHTTPHandlerRedirectError(t *testing.T) {
+	s, err := tftp.NewServer(tftp.Options{
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			return nil, &tftp.RedirectError{Location: "http://mirror.example/images/installer.iso"}
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/installer.iso", nil))
+
+	if rr.Code != http.StatusFound {
+		t.Fatalf("unexpected status: got %d", rr.Code)
+	}
+	if loc := rr.Header().Get("Location"); loc != "http://mirror.example/images/installer.iso" {
+		t.Fatalf("unexpected Location: %q", loc)
+	}
+}
+
+func TestHTTPHandlerExposeErrors(t *testing.T) {
+	s, err := tftp.NewServer(tftp.Options{
+		ExposeErrors: true,
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			return nil, errors.New("no profile for host")
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/boot.ipxe", nil))
+
+	if !strings.Contains(rr.Body.String(), "no profile for host") {
+		t.Fatalf("expected error text with ExposeErrors, got %q", rr.Body.String())
+	}
+}
+
+func newArtifactServer(t *testing.T, content string, modTime time.Time) http.Handler {
+	t.Helper()
+
+	s, err := tftp.NewServer(tftp.Options{
+		Getter: tftp.StreamGetterFunc(func(gt tftp.GetType, ctx *tftp.Context) (*tftp.Artifact, error) {
+			return &tftp.Artifact{Content: strings.NewReader(content), Size: int64(len(content)), ModTime: modTime}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	return s.HTTPHandler()
+}
+
+func TestHTTPHandlerRange(t *testing.T) {
+	handler := newArtifactServer(t, "0123456789", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	req := httptest.NewRequest(http.MethodGet, "/initrd.img", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("unexpected status: got %d", rr.Code)
+	}
+	if got := rr.Body.String(); got != "2345" {
+		t.Fatalf("unexpected body %q", got)
+	}
+	if got := rr.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Fatalf("unexpected Content-Range %q", got)
+	}
+	if rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("expected Accept-Ranges: bytes")
+	}
+}
+
+func TestHTTPHandlerHead(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	handler := newArtifactServer(t, "0123456789", modTime)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "/vmlinuz", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status: got %d", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Fatalf("expected empty body for HEAD, got %d bytes", rr.Body.Len())
+	}
+	if got := rr.Header().Get("Content-Length"); got != "10" {
+		t.Fatalf("unexpected Content-Length %q", got)
+	}
+	if got := rr.Header().Get("Last-Modified"); got != modTime.Format(http.TimeFormat) {
+		t.Fatalf("unexpected Last-Modified %q", got)
+	}
+	if rr.Header().Get("ETag") == "" {
+		t.Fatalf("expected derived ETag")
+	}
+}
+
+func TestHTTPHandlerConditionalRequests(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	handler := newArtifactServer(t, "0123456789", modTime)
+
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/vmlinuz", nil))
+	etag := first.Header().Get("ETag")
+
+	req := httptest.NewRequest(http.MethodGet, "/vmlinuz", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match: unexpected status %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/vmlinuz", nil)
+	req.Header.Set("If-Modified-Since", modTime.Add(time.Hour).Format(http.TimeFormat))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since: unexpected status %d", rr.Code)
+	}
+}
+
+func TestHTTPHandlerRejectsOtherMethods(t *testing.T) {
+	handler := newArtifactServer(t, "x", time.Time{})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/boot.ipxe", nil))
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status: got %d", rr.Code)
+	}
+}
+
+func TestHTTPHandlerContentTypeDefaults(t *testing.T) {
+	tests := []struct {
+		path    string
+		content string
+		want    string
+	}{
+		{path: "/boot.ipxe", content: "#!ipxe\nchain http://x/y", want: "text/plain; charset=utf-8"},
+		{path: "/cloud-init/user-data.yaml", content: "#cloud-config\n", want: "application/yaml"},
+		{path: "/ks.cfg", content: "install\n", want: "text/plain; charset=utf-8"},
+		{path: "/menu", content: "<html><body>menu</body></html>", want: "text/html; charset=utf-8"},
+		{path: "/pxelinux.0", content: "\x00\x01\x02\x03", want: "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			handler := newArtifactServer(t, tt.content, time.Time{})
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if got := rr.Header().Get("Content-Type"); got != tt.want {
+				t.Fatalf("unexpected Content-Type %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPHandlerArtifactHeaders(t *testing.T) {
+	s, err := tftp.NewServer(tftp.Options{
+		Getter: tftp.StreamGetterFunc(func(gt tftp.GetType, ctx *tftp.Context) (*tftp.Artifact, error) {
+			return &tftp.Artifact{
+				Content:            strings.NewReader("key: value\n"),
+				Size:               11,
+				ContentType:        "text/x-shellscript",
+				CacheControl:       "no-store",
+				ContentDisposition: `attachment; filename="seed.sh"`,
+				Header:             http.Header{"X-Boot-Profile": []string{"rack-7"}},
+			}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/seed.yaml", nil))
+
+	want := map[string]string{
+		"Content-Type":        "text/x-shellscript",
+		"Cache-Control":       "no-store",
+		"Content-Disposition": `attachment; filename="seed.sh"`,
+		"X-Boot-Profile":      "rack-7",
+	}
+	for key, value := range want {
+		if got := rr.Header().Get(key); got != value {
+			t.Fatalf("unexpected %s: %q, want %q", key, got, value)
+		}
+	}
+}
+
 func TestGetWithoutGetterErrors(t *testing.T) {
 	s := &tftp.Server{}
 	if _, err := s.Get(tftp.GetTypeHTTP, &tftp.Context{}); err == nil {
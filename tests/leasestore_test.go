@@ -0,0 +1,230 @@
+package tftp_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/opnlaas/tftp"
+)
+
+func openLeaseStore(t *testing.T, path string) *tftp.FileLeaseStore {
+	t.Helper()
+
+	store, err := tftp.NewFileLeaseStore(path)
+	if err != nil {
+		t.Fatalf("NewFileLeaseStore failed: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestFileLeaseStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.jsonl")
+	store := openLeaseStore(t, path)
+
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	a, _ := net.ParseMAC("00:11:22:33:44:01")
+	b, _ := net.ParseMAC("00:11:22:33:44:02")
+	if err := store.Put(tftp.DHCPLease{MAC: a, IP: net.IPv4(192, 0, 2, 11), Expiry: expiry}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put(tftp.DHCPLease{MAC: b, IP: net.IPv4(192, 0, 2, 12), Expiry: expiry}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put(tftp.DHCPLease{MAC: a, IP: net.IPv4(192, 0, 2, 13), Expiry: expiry}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Delete(b); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	_ = store.Close()
+
+	// Simulate a crash mid-append.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	_, _ = f.WriteString(`{"op":"put","mac":"00:11`)
+	_ = f.Close()
+
+	reopened := openLeaseStore(t, path)
+	lease, err := reopened.Get(a)
+	if err != nil || lease == nil {
+		t.Fatalf("expected lease for %s, got %v, %v", a, lease, err)
+	}
+	if !lease.IP.Equal(net.IPv4(192, 0, 2, 13)) || !lease.Expiry.Equal(expiry) {
+		t.Fatalf("unexpected lease after reopen: %#v", lease)
+	}
+	if lease, _ := reopened.Get(b); lease != nil {
+		t.Fatalf("expected deleted lease to stay deleted, got %#v", lease)
+	}
+
+	// A record written after the crash must not be glued onto the partial line.
+	if err := reopened.Put(tftp.DHCPLease{MAC: b, IP: net.IPv4(192, 0, 2, 14), Expiry: expiry}); err != nil {
+		t.Fatalf("Put after crash failed: %v", err)
+	}
+	_ = reopened.Close()
+
+	again := openLeaseStore(t, path)
+	if lease, err := again.Get(b); err != nil || lease == nil || !lease.IP.Equal(net.IPv4(192, 0, 2, 14)) {
+		t.Fatalf("expected lease written after crash, got %#v, %v", lease, err)
+	}
+	if lease, _ := again.Get(a); lease == nil || !lease.IP.Equal(net.IPv4(192, 0, 2, 13)) {
+		t.Fatalf("unexpected lease for %s after second reopen: %#v", a, lease)
+	}
+}
+
+func TestFileLeaseStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.jsonl")
+	store := openLeaseStore(t, path)
+
+	hw, _ := net.ParseMAC("00:11:22:33:44:01")
+	for i := 0; i < 1000; i++ {
+		lease := tftp.DHCPLease{MAC: hw, IP: net.IPv4(192, 0, 2, byte(10+i%100)), Expiry: time.Now()}
+		if err := store.Put(lease); err != nil {
+			t.Fatalf("Put %d failed: %v", i, err)
+		}
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if lines := bytes.Count(raw, []byte("\n")); lines > 300 {
+		t.Fatalf("expected journal to be compacted, found %d records", lines)
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	reopened := openLeaseStore(t, path)
+	leases, _ := reopened.All()
+	if len(leases) != 1 || !leases[0].IP.Equal(net.IPv4(192, 0, 2, 109)) {
+		t.Fatalf("unexpected leases after compaction: %#v", leases)
+	}
+}
+
+func TestFileLeaseStoreCompactionDropsExpiredLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.jsonl")
+	store := openLeaseStore(t, path)
+	store.ExpiredRetention = time.Hour
+
+	stale, _ := net.ParseMAC("00:11:22:33:44:01")
+	recent, _ := net.ParseMAC("00:11:22:33:44:02")
+	if err := store.Put(tftp.DHCPLease{MAC: stale, IP: net.IPv4(192, 0, 2, 10), Expiry: time.Now().Add(-2 * time.Hour)}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put(tftp.DHCPLease{MAC: recent, IP: net.IPv4(192, 0, 2, 11), Expiry: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if lease, _ := store.Get(stale); lease != nil {
+		t.Fatalf("expected lease expired beyond retention to be dropped, got %#v", lease)
+	}
+
+	reopened := openLeaseStore(t, path)
+	leases, _ := reopened.All()
+	if len(leases) != 1 || !leases[0].IP.Equal(net.IPv4(192, 0, 2, 11)) {
+		t.Fatalf("unexpected leases after compaction: %#v", leases)
+	}
+}
+
+func TestDHCPHandlerRecordsAckedLeases(t *testing.T) {
+	store := openLeaseStore(t, filepath.Join(t.TempDir(), "leases.jsonl"))
+
+	hw, _ := net.ParseMAC("00:11:22:33:44:55")
+	previous := net.IPv4(192, 0, 2, 42)
+	if err := store.Put(tftp.DHCPLease{MAC: hw, IP: previous, Expiry: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	var seen *tftp.DHCPLease
+	allocator := tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		seen = req.PreviousLease
+		return &tftp.DHCPOffer{YourIP: net.IPv4(192, 0, 2, 43), LeaseTime: time.Hour}, nil
+	})
+
+	srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: allocator, DHCPLeaseStore: store})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	discover, _ := dhcpv4.NewDiscovery(hw)
+	srv.DHCPHandler(&recordingPacketConn{}, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, discover)
+	if seen == nil || !seen.IP.Equal(previous) {
+		t.Fatalf("expected allocator to see stored lease, got %#v", seen)
+	}
+	if lease, _ := store.Get(hw); !lease.IP.Equal(previous) {
+		t.Fatalf("DISCOVER must not change the stored lease, got %s", lease.IP)
+	}
+
+	request, _ := dhcpv4.New(dhcpv4.WithHwAddr(hw), dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))
+	srv.DHCPHandler(&recordingPacketConn{}, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, request)
+
+	lease, _ := store.Get(hw)
+	if lease == nil || !lease.IP.Equal(net.IPv4(192, 0, 2, 43)) || time.Until(lease.Expiry) < 59*time.Minute {
+		t.Fatalf("expected ACKed lease to be stored, got %#v", lease)
+	}
+}
+
+func TestDHCPHandlerStoresDefaultLeaseTime(t *testing.T) {
+	store := openLeaseStore(t, filepath.Join(t.TempDir(), "leases.jsonl"))
+
+	allocator := tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		return &tftp.DHCPOffer{YourIP: net.IPv4(192, 0, 2, 43)}, nil
+	})
+	srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: allocator, DHCPLeaseStore: store})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	hw, _ := net.ParseMAC("00:11:22:33:44:55")
+	request, _ := dhcpv4.New(dhcpv4.WithHwAddr(hw), dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))
+	srv.DHCPHandler(&recordingPacketConn{}, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, request)
+
+	lease, _ := store.Get(hw)
+	if lease == nil || time.Until(lease.Expiry) < 59*time.Minute {
+		t.Fatalf("expected lease without LeaseTime to be stored with the default, got %#v", lease)
+	}
+}
+
+func TestPoolAllocatorRestoresLeases(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+		Network:    mustCIDR(t, "192.0.2.0/24"),
+		RangeStart: net.IPv4(192, 0, 2, 10),
+		RangeEnd:   net.IPv4(192, 0, 2, 20),
+	})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	owner, _ := net.ParseMAC("00:11:22:33:44:01")
+	pool.RestoreLeases([]tftp.DHCPLease{
+		{MAC: owner, IP: net.IPv4(192, 0, 2, 10), Expiry: time.Now().Add(time.Hour)},
+		{MAC: owner, IP: net.IPv4(198, 51, 100, 1), Expiry: time.Now().Add(time.Hour)},
+	})
+
+	other, err := pool.Offer(discoverFrom("00:11:22:33:44:02"))
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if other.YourIP.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("restored address was reissued to another client")
+	}
+
+	again, err := pool.Offer(discoverFrom("00:11:22:33:44:01"))
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if !again.YourIP.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("expected restored client to keep its address, got %s", again.YourIP)
+	}
+}
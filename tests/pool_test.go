@@ -0,0 +1,311 @@
+package tftp_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/opnlaas/tftp"
+)
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q) failed: %v", cidr, err)
+	}
+	return network
+}
+
+func discoverFrom(mac string) *tftp.DHCPRequest {
+	hw, _ := net.ParseMAC(mac)
+	return &tftp.DHCPRequest{MessageType: dhcpv4.MessageTypeDiscover, ClientMAC: hw}
+}
+
+func TestPoolAllocatorAllocatesAndRemembers(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+		Network:    mustCIDR(t, "192.0.2.0/24"),
+		RangeStart: net.IPv4(192, 0, 2, 10),
+		RangeEnd:   net.IPv4(192, 0, 2, 20),
+		Exclude:    []net.IP{net.IPv4(192, 0, 2, 10)},
+		Template: tftp.DHCPOffer{
+			Router:   net.IPv4(192, 0, 2, 1),
+			BootFile: "pxelinux.0",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	first, err := pool.Offer(discoverFrom("00:11:22:33:44:01"))
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if !first.YourIP.Equal(net.IPv4(192, 0, 2, 11)) {
+		t.Fatalf("expected first free address after exclusion, got %s", first.YourIP)
+	}
+	if first.SubnetMask.String() != "ffffff00" || first.BootFile != "pxelinux.0" || first.LeaseTime != time.Hour {
+		t.Fatalf("template not applied: %#v", first)
+	}
+
+	second, err := pool.Offer(discoverFrom("00:11:22:33:44:02"))
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if !second.YourIP.Equal(net.IPv4(192, 0, 2, 12)) {
+		t.Fatalf("expected next address, got %s", second.YourIP)
+	}
+
+	again, err := pool.Offer(discoverFrom("00:11:22:33:44:01"))
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if !again.YourIP.Equal(first.YourIP) {
+		t.Fatalf("expected client to keep %s, got %s", first.YourIP, again.YourIP)
+	}
+
+	if leases := pool.Leases(); len(leases) != 2 {
+		t.Fatalf("expected two leases, got %d", len(leases))
+	}
+}
+
+func TestPoolAllocatorReservationsAndRequestedIP(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+		Network:      mustCIDR(t, "192.0.2.0/24"),
+		RangeStart:   net.IPv4(192, 0, 2, 10),
+		RangeEnd:     net.IPv4(192, 0, 2, 20),
+		Reservations: map[string]net.IP{"AA-BB-CC-DD-EE-FF": net.IPv4(192, 0, 2, 15)},
+	})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	reserved, err := pool.Offer(discoverFrom("aa:bb:cc:dd:ee:ff"))
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if !reserved.YourIP.Equal(net.IPv4(192, 0, 2, 15)) {
+		t.Fatalf("expected reservation, got %s", reserved.YourIP)
+	}
+
+	req := discoverFrom("00:11:22:33:44:55")
+	req.RequestedIP = net.IPv4(192, 0, 2, 15)
+	other, err := pool.Offer(req)
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if other.YourIP.Equal(net.IPv4(192, 0, 2, 15)) {
+		t.Fatalf("reserved address handed to another client")
+	}
+
+	req = discoverFrom("00:11:22:33:44:66")
+	req.RequestedIP = net.IPv4(192, 0, 2, 18)
+	requested, err := pool.Offer(req)
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if !requested.YourIP.Equal(net.IPv4(192, 0, 2, 18)) {
+		t.Fatalf("expected requested address, got %s", requested.YourIP)
+	}
+}
+
+func TestPoolAllocatorReusesExpiredLeases(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+		Network:    mustCIDR(t, "192.0.2.0/24"),
+		RangeStart: net.IPv4(192, 0, 2, 10),
+		RangeEnd:   net.IPv4(192, 0, 2, 10),
+	})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+	pool.OfferHold = 10 * time.Millisecond
+
+	if _, err := pool.Offer(discoverFrom("00:11:22:33:44:01")); err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+
+	if _, err := pool.Offer(discoverFrom("00:11:22:33:44:02")); !errors.Is(err, tftp.ErrPoolExhausted) {
+		t.Fatalf("expected ErrPoolExhausted while the offer is held, got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	offer, err := pool.Offer(discoverFrom("00:11:22:33:44:02"))
+	if err != nil {
+		t.Fatalf("expected expired hold to be reused, got %v", err)
+	}
+	if !offer.YourIP.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("unexpected address %s", offer.YourIP)
+	}
+}
+
+func TestPoolAllocatorSelectsSubnetByRelay(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(
+		tftp.DHCPSubnet{Network: mustCIDR(t, "192.0.2.0/24")},
+		tftp.DHCPSubnet{Network: mustCIDR(t, "198.51.100.0/24")},
+	)
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	req := discoverFrom("00:11:22:33:44:01")
+	req.GatewayIP = net.IPv4(198, 51, 100, 1)
+	offer, err := pool.Offer(req)
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if !mustCIDR(t, "198.51.100.0/24").Contains(offer.YourIP) {
+		t.Fatalf("expected address from relay subnet, got %s", offer.YourIP)
+	}
+
+	req.GatewayIP = net.IPv4(203, 0, 113, 1)
+	if _, err := pool.Offer(req); err == nil {
+		t.Fatalf("expected error for relay without a configured subnet")
+	}
+}
+
+func TestPoolAllocatorAsDHCPAllocator(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{Network: mustCIDR(t, "192.0.2.0/24")})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: pool})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if err != nil {
+		t.Fatalf("NewDiscovery failed: %v", err)
+	}
+
+	pc := &recordingPacketConn{}
+	srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4zero, Port: 68}, req)
+
+	resp, err := dhcpv4.FromBytes(pc.data)
+	if err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if !resp.YourIPAddr.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("unexpected yiaddr %s", resp.YourIPAddr)
+	}
+}
+
+func TestPoolAllocatorReleaseAndDecline(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+		Network:    mustCIDR(t, "192.0.2.0/24"),
+		RangeStart: net.IPv4(192, 0, 2, 10),
+		RangeEnd:   net.IPv4(192, 0, 2, 11),
+	})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	first := discoverFrom("00:11:22:33:44:01")
+	if _, err := pool.Offer(first); err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if _, err := pool.Offer(discoverFrom("00:11:22:33:44:02")); err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+
+	// Releasing frees .10 for the next client.
+	first.MessageType = dhcpv4.MessageTypeRelease
+	if err := pool.Release(first); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	third, err := pool.Offer(discoverFrom("00:11:22:33:44:03"))
+	if err != nil {
+		t.Fatalf("expected released address to be reusable, got %v", err)
+	}
+	if !third.YourIP.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("unexpected address %s", third.YourIP)
+	}
+
+	// Declining .10 keeps it from everyone, including the decliner.
+	decline := discoverFrom("00:11:22:33:44:03")
+	decline.MessageType = dhcpv4.MessageTypeDecline
+	decline.RequestedIP = net.IPv4(192, 0, 2, 10)
+	if err := pool.Decline(decline); err != nil {
+		t.Fatalf("Decline failed: %v", err)
+	}
+	if _, err := pool.Offer(discoverFrom("00:11:22:33:44:03")); !errors.Is(err, tftp.ErrPoolExhausted) {
+		t.Fatalf("expected quarantined address to be withheld, got %v", err)
+	}
+	for _, lease := range pool.Leases() {
+		if lease.IP.Equal(net.IPv4(192, 0, 2, 10)) {
+			t.Fatalf("declined lease still in table: %#v", lease)
+		}
+	}
+}
+
+func TestPoolAllocatorInformDoesNotAllocate(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+		Network:  mustCIDR(t, "192.0.2.0/24"),
+		Template: tftp.DHCPOffer{Router: net.IPv4(192, 0, 2, 1)},
+	})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	req := discoverFrom("00:11:22:33:44:01")
+	req.MessageType = dhcpv4.MessageTypeInform
+	req.CurrentIP = net.IPv4(192, 0, 2, 77)
+	offer, err := pool.Offer(req)
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if offer.YourIP != nil || !offer.Router.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("unexpected INFORM offer %#v", offer)
+	}
+	if leases := pool.Leases(); len(leases) != 0 {
+		t.Fatalf("INFORM must not create leases, got %#v", leases)
+	}
+}
+
+func TestPoolAllocatorRefusesMismatchedRequests(t *testing.T) {
+	pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+		Network:      mustCIDR(t, "192.0.2.0/24"),
+		RangeStart:   net.IPv4(192, 0, 2, 10),
+		RangeEnd:     net.IPv4(192, 0, 2, 20),
+		Reservations: map[string]net.IP{"00:11:22:33:44:09": net.IPv4(192, 0, 2, 5)},
+	})
+	if err != nil {
+		t.Fatalf("NewPoolAllocator failed: %v", err)
+	}
+
+	request := func(mac string, requested, current net.IP) error {
+		req := discoverFrom(mac)
+		req.MessageType = dhcpv4.MessageTypeRequest
+		req.RequestedIP, req.CurrentIP = requested, current
+		_, err := pool.Offer(req)
+		return err
+	}
+
+	if err := request("00:11:22:33:44:01", net.IPv4(192, 0, 2, 12), nil); err != nil {
+		t.Fatalf("INIT-REBOOT for a free address failed: %v", err)
+	}
+	if err := request("00:11:22:33:44:01", nil, net.IPv4(192, 0, 2, 12)); err != nil {
+		t.Fatalf("RENEW of own lease failed: %v", err)
+	}
+
+	for name, err := range map[string]error{
+		"wrong subnet":        request("00:11:22:33:44:02", net.IPv4(198, 51, 100, 7), nil),
+		"leased to another":   request("00:11:22:33:44:02", nil, net.IPv4(192, 0, 2, 12)),
+		"outside the range":   request("00:11:22:33:44:02", net.IPv4(192, 0, 2, 30), nil),
+		"someone's reserved":  request("00:11:22:33:44:02", net.IPv4(192, 0, 2, 5), nil),
+		"not the reservation": request("00:11:22:33:44:09", net.IPv4(192, 0, 2, 13), nil),
+	} {
+		if !errors.Is(err, tftp.ErrDHCPNak) {
+			t.Errorf("%s: expected ErrDHCPNak, got %v", name, err)
+		}
+	}
+
+	if err := request("00:11:22:33:44:09", net.IPv4(192, 0, 2, 5), nil); err != nil {
+		t.Fatalf("REQUEST for own reservation failed: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package tftp_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/opnlaas/tftp"
+)
+
+func proxyAllocator(calls *int) tftp.DHCPAllocator {
+	return tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		*calls++
+		return &tftp.DHCPOffer{
+			YourIP:     net.IPv4(192, 0, 2, 100),
+			SubnetMask: net.IPv4Mask(255, 255, 255, 0),
+			Router:     net.IPv4(192, 0, 2, 1),
+			LeaseTime:  time.Hour,
+			BootFile:   "ipxe.efi",
+			NextServer: net.IPv4(192, 0, 2, 5),
+		}, nil
+	})
+}
+
+func pxeMessage(t *testing.T, mt dhcpv4.MessageType, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	modifiers = append([]dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}),
+		dhcpv4.WithMessageType(mt),
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003016")),
+	}, modifiers...)
+	m, err := dhcpv4.New(modifiers...)
+	if err != nil {
+		t.Fatalf("build %s: %v", mt, err)
+	}
+	return m
+}
+
+func checkProxyReply(t *testing.T, data []byte, want dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	resp, err := dhcpv4.FromBytes(data)
+	if err != nil {
+		t.Fatalf("failed to parse reply: %v", err)
+	}
+	if resp.MessageType() != want {
+		t.Fatalf("expected %s, got %s", want, resp.MessageType())
+	}
+	if !resp.YourIPAddr.IsUnspecified() {
+		t.Fatalf("proxy reply must not assign an address, got yiaddr %s", resp.YourIPAddr)
+	}
+	for _, code := range []dhcpv4.OptionCode{dhcpv4.OptionSubnetMask, dhcpv4.OptionRouter, dhcpv4.OptionIPAddressLeaseTime} {
+		if resp.Options.Has(code) {
+			t.Fatalf("proxy reply must not carry %s", code)
+		}
+	}
+	if resp.ClassIdentifier() != "PXEClient" {
+		t.Fatalf("expected vendor class PXEClient, got %q", resp.ClassIdentifier())
+	}
+	if !bytes.Equal(resp.GetOneOption(dhcpv4.OptionVendorSpecificInformation), []byte{6, 1, 8, 255}) {
+		t.Fatalf("unexpected option 43 %x", resp.GetOneOption(dhcpv4.OptionVendorSpecificInformation))
+	}
+	if resp.BootFileNameOption() != "ipxe.efi" {
+		t.Fatalf("expected boot file, got %q", resp.BootFileNameOption())
+	}
+	return resp
+}
+
+func TestProxyDHCPAnswersOnlyPXEDiscovers(t *testing.T) {
+	var calls int
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPAllocator: proxyAllocator(&calls),
+		DHCPServerIP:  net.IPv4(192, 0, 2, 5),
+		ProxyDHCP:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	peer := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+
+	uuid := append([]byte{0}, bytes.Repeat([]byte{0xab}, 16)...)
+	pc := &recordingPacketConn{}
+	srv.DHCPHandler(pc, peer, pxeMessage(t, dhcpv4.MessageTypeDiscover,
+		dhcpv4.WithGeneric(dhcpv4.OptionClientMachineIdentifier, uuid)))
+	resp := checkProxyReply(t, pc.data, dhcpv4.MessageTypeOffer)
+	if !bytes.Equal(resp.GetOneOption(dhcpv4.OptionClientMachineIdentifier), uuid) {
+		t.Fatalf("expected option 97 to be echoed")
+	}
+
+	plain, _ := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66})
+	pc = &recordingPacketConn{}
+	srv.DHCPHandler(pc, peer, plain)
+	if pc.writes != 0 {
+		t.Fatalf("expected non-PXE discover to be ignored")
+	}
+
+	pc = &recordingPacketConn{}
+	srv.DHCPHandler(pc, peer, pxeMessage(t, dhcpv4.MessageTypeRequest))
+	if pc.writes != 0 {
+		t.Fatalf("expected REQUEST on port 67 to be left to the real DHCP server")
+	}
+	if calls != 1 {
+		t.Fatalf("expected allocator to be consulted once, got %d", calls)
+	}
+
+	menu := tftp.DHCPOffer{BootFile: "ipxe.efi"}
+	if err := menu.SetVendorOptions(map[uint8][]byte{6: {8}, 10: {5, 'B', 'o', 'o', 't'}}); err != nil {
+		t.Fatalf("SetVendorOptions failed: %v", err)
+	}
+	srv.Options.DHCPAllocator = tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		return &menu, nil
+	})
+	pc = &recordingPacketConn{}
+	srv.DHCPHandler(pc, peer, pxeMessage(t, dhcpv4.MessageTypeDiscover))
+	resp, _ = dhcpv4.FromBytes(pc.data)
+	if vendor := resp.GetOneOption(dhcpv4.OptionVendorSpecificInformation); !bytes.Equal(vendor, menu.Options[43]) {
+		t.Fatalf("expected allocator option 43 in proxy reply, got %x", vendor)
+	}
+}
+
+func TestPXEBootServerListener(t *testing.T) {
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v", err)
+	}
+	addr := probe.LocalAddr().(*net.UDPAddr)
+	_ = probe.Close()
+
+	var calls int
+	srv, err := tftp.NewServer(tftp.Options{
+		DHCPAllocator: proxyAllocator(&calls),
+		DHCPServerIP:  net.IPv4(192, 0, 2, 5),
+		ListenAddrPXE: addr.String(),
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	req := pxeMessage(t, dhcpv4.MessageTypeRequest)
+	req.ClientIPAddr = net.IPv4(127, 0, 0, 1)
+	if _, err := conn.Write(req.ToBytes()); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply from PXE listener: %v", err)
+	}
+	checkProxyReply(t, buf[:n], dhcpv4.MessageTypeAck)
+}
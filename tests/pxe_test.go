@@ -0,0 +1,266 @@
+package tftp_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/opnlaas/tftp"
+)
+
+func TestDHCPHandlerParsesPXEOptions(t *testing.T) {
+	var seen *tftp.DHCPRequest
+	allocator := tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		seen = req
+		return &tftp.DHCPOffer{YourIP: net.IPv4(192, 0, 2, 100)}, nil
+	})
+
+	srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: allocator})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	uuid := []byte{0, 0x4c, 0x4c, 0x45, 0x44, 0x00, 0x10, 0x80, 0x31, 0x80, 0xb4, 0xc0, 0x4f, 0x4d, 0x4e, 0x30, 0x32}
+	m, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003016")),
+		dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_X86_64)),
+		dhcpv4.WithGeneric(dhcpv4.OptionClientNetworkInterfaceIdentifier, []byte{1, 3, 16}),
+		dhcpv4.WithGeneric(dhcpv4.OptionClientMachineIdentifier, uuid),
+	)
+	if err != nil {
+		t.Fatalf("NewDiscovery failed: %v", err)
+	}
+
+	srv.DHCPHandler(&recordingPacketConn{}, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, m)
+
+	if seen == nil {
+		t.Fatalf("allocator was not called")
+	}
+	if !seen.IsPXE() || seen.IsHTTPBoot() {
+		t.Fatalf("expected PXE client, vendor class %q", seen.VendorClass)
+	}
+	if arch, ok := seen.Arch(); !ok || arch != iana.EFI_X86_64 {
+		t.Fatalf("unexpected arch %v (%v)", arch, ok)
+	}
+	if seen.ClientInterface == nil || *seen.ClientInterface != (tftp.PXEInterface{Type: 1, Major: 3, Minor: 16}) {
+		t.Fatalf("unexpected interface %#v", seen.ClientInterface)
+	}
+	if seen.ClientUUID != "4c4c4544-0010-8031-80b4-c04f4d4e3032" {
+		t.Fatalf("unexpected UUID %q", seen.ClientUUID)
+	}
+}
+
+func TestBootFilesForArchitecture(t *testing.T) {
+	files := tftp.BootFiles{
+		BIOS:    "undionly.kpxe",
+		UEFI64:  "ipxe.efi",
+		ARM64:   "ipxe-arm64.efi",
+		HTTP64:  "http://192.0.2.1/ipxe.efi",
+		Arch:    map[iana.Arch]string{iana.EFI_RISCV64: "ipxe-riscv64.efi"},
+		Default: "pxelinux.0",
+	}
+
+	cases := []struct {
+		arch []iana.Arch
+		want string
+	}{
+		{nil, "pxelinux.0"},
+		{[]iana.Arch{iana.INTEL_X86PC}, "undionly.kpxe"},
+		{[]iana.Arch{iana.EFI_X86_64}, "ipxe.efi"},
+		{[]iana.Arch{iana.EFI_BC}, "ipxe.efi"},
+		{[]iana.Arch{iana.EFI_ARM64}, "ipxe-arm64.efi"},
+		{[]iana.Arch{iana.EFI_X86_64_HTTP}, "http://192.0.2.1/ipxe.efi"},
+		{[]iana.Arch{iana.EFI_RISCV64}, "ipxe-riscv64.efi"},
+		{[]iana.Arch{iana.EFI_IA32}, "pxelinux.0"},
+	}
+	for _, tc := range cases {
+		if got := files.For(&tftp.DHCPRequest{ClientArch: tc.arch}); got != tc.want {
+			t.Errorf("arch %v: got %q, want %q", tc.arch, got, tc.want)
+		}
+	}
+
+	allocator := tftp.WithBootFiles(tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		return &tftp.DHCPOffer{BootFile: "fallback"}, nil
+	}), tftp.BootFiles{ARM64: "ipxe-arm64.efi"})
+
+	offer, _ := allocator.Offer(&tftp.DHCPRequest{ClientArch: []iana.Arch{iana.EFI_ARM64}})
+	if offer.BootFile != "ipxe-arm64.efi" {
+		t.Fatalf("expected mapped boot file, got %q", offer.BootFile)
+	}
+	offer, _ = allocator.Offer(&tftp.DHCPRequest{ClientArch: []iana.Arch{iana.INTEL_X86PC}})
+	if offer.BootFile != "fallback" {
+		t.Fatalf("expected unmapped arch to keep allocator boot file, got %q", offer.BootFile)
+	}
+}
+
+func TestBootFilesMarksHTTPBootOffers(t *testing.T) {
+	allocator := tftp.WithBootFiles(tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		return &tftp.DHCPOffer{YourIP: net.IPv4(192, 0, 2, 100), SubnetMask: net.IPv4Mask(255, 255, 255, 0)}, nil
+	}), tftp.BootFiles{UEFI64: "ipxe.efi", HTTP64: "http://192.0.2.1/boot/ipxe.efi"})
+
+	srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: allocator})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	discover := func(class string, arch iana.Arch) *dhcpv4.DHCPv4 {
+		t.Helper()
+		m, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+			dhcpv4.WithOption(dhcpv4.OptClassIdentifier(class)),
+			dhcpv4.WithOption(dhcpv4.OptClientArch(arch)),
+		)
+		if err != nil {
+			t.Fatalf("NewDiscovery failed: %v", err)
+		}
+		pc := &recordingPacketConn{}
+		srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, m)
+		resp, err := dhcpv4.FromBytes(pc.data)
+		if err != nil {
+			t.Fatalf("failed to parse reply: %v", err)
+		}
+		return resp
+	}
+
+	resp := discover("HTTPClient:Arch:00016:UNDI:003001", iana.EFI_X86_64_HTTP)
+	if got := resp.ClassIdentifier(); got != "HTTPClient" {
+		t.Fatalf("expected option 60 HTTPClient for HTTP boot, got %q", got)
+	}
+	if got := resp.BootFileNameOption(); got != "http://192.0.2.1/boot/ipxe.efi" {
+		t.Fatalf("unexpected HTTP boot URI %q", got)
+	}
+
+	resp = discover("PXEClient:Arch:00007:UNDI:003016", iana.EFI_X86_64)
+	if got := resp.ClassIdentifier(); got != "" {
+		t.Fatalf("PXE client got option 60 %q", got)
+	}
+	if got := resp.BootFileNameOption(); got != "ipxe.efi" {
+		t.Fatalf("unexpected PXE boot file %q", got)
+	}
+}
+
+func TestIPXEChainload(t *testing.T) {
+	var seen *tftp.DHCPRequest
+	allocator := tftp.WithIPXEChainload(tftp.DHCPAllocatorFunc(func(req *tftp.DHCPRequest) (*tftp.DHCPOffer, error) {
+		seen = req
+		return &tftp.DHCPOffer{YourIP: net.IPv4(192, 0, 2, 100), BootFile: "undionly.kpxe"}, nil
+	}), "http://192.0.2.1/boot.ipxe")
+
+	srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: allocator})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover := func(modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+		t.Helper()
+		pc := &recordingPacketConn{}
+		m, err := dhcpv4.NewDiscovery(hw, modifiers...)
+		if err != nil {
+			t.Fatalf("NewDiscovery failed: %v", err)
+		}
+		srv.DHCPHandler(pc, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, m)
+		resp, err := dhcpv4.FromBytes(pc.data)
+		if err != nil {
+			t.Fatalf("failed to parse reply: %v", err)
+		}
+		return resp
+	}
+
+	if resp := discover(); resp.BootFileNameOption() != "undionly.kpxe" {
+		t.Fatalf("expected firmware to get the iPXE binary, got %q", resp.BootFileNameOption())
+	}
+	if seen.IsIPXE() {
+		t.Fatalf("plain firmware detected as iPXE")
+	}
+
+	resp := discover(
+		dhcpv4.WithGeneric(dhcpv4.OptionUserClassInformation, []byte("iPXE")),
+		dhcpv4.WithGeneric(dhcpv4.OptionEtherboot, []byte{19, 1, 1, 23, 1, 1, 99}),
+	)
+	if resp.BootFileNameOption() != "http://192.0.2.1/boot.ipxe" {
+		t.Fatalf("expected iPXE to get the script URL, got %q", resp.BootFileNameOption())
+	}
+	if len(seen.UserClass) != 1 || seen.UserClass[0] != "iPXE" {
+		t.Fatalf("unexpected user class %q", seen.UserClass)
+	}
+	if len(seen.IPXEFeatures) != 2 || seen.IPXEFeatures[19][0] != 1 || seen.IPXEFeatures[23][0] != 1 {
+		t.Fatalf("unexpected iPXE features %v", seen.IPXEFeatures)
+	}
+
+	// Feature list alone is enough, e.g. builds that omit the user class.
+	discover(dhcpv4.WithGeneric(dhcpv4.OptionEtherboot, []byte{19, 1, 1}))
+	if !seen.IsIPXE() {
+		t.Fatalf("expected option 175 to identify iPXE")
+	}
+}
+
+func TestBootFileWrappersKeepPoolExtensions(t *testing.T) {
+	wrappers := map[string]func(tftp.DHCPAllocator) tftp.DHCPAllocator{
+		"WithBootFiles": func(next tftp.DHCPAllocator) tftp.DHCPAllocator {
+			return tftp.WithBootFiles(next, tftp.BootFiles{Default: "pxelinux.0"})
+		},
+		"WithIPXEChainload": func(next tftp.DHCPAllocator) tftp.DHCPAllocator {
+			return tftp.WithIPXEChainload(tftp.WithBootFiles(next, tftp.BootFiles{Default: "pxelinux.0"}), "http://192.0.2.1/boot.ipxe")
+		},
+	}
+
+	for name, wrap := range wrappers {
+		t.Run(name, func(t *testing.T) {
+			pool, err := tftp.NewPoolAllocator(tftp.DHCPSubnet{
+				Network:    mustCIDR(t, "192.0.2.0/24"),
+				RangeStart: net.IPv4(192, 0, 2, 10),
+				RangeEnd:   net.IPv4(192, 0, 2, 11),
+			})
+			if err != nil {
+				t.Fatalf("NewPoolAllocator failed: %v", err)
+			}
+			allocator := wrap(pool)
+
+			restorer, ok := allocator.(tftp.DHCPLeaseRestorer)
+			if !ok {
+				t.Fatalf("wrapped pool does not implement DHCPLeaseRestorer")
+			}
+			restored, _ := net.ParseMAC("00:11:22:33:44:09")
+			restorer.RestoreLeases([]tftp.DHCPLease{{MAC: restored, IP: net.IPv4(192, 0, 2, 11), Expiry: time.Now().Add(time.Hour)}})
+
+			srv, err := tftp.NewServer(tftp.Options{DHCPAllocator: allocator})
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+
+			offer, err := allocator.Offer(discoverFrom("00:11:22:33:44:01"))
+			if err != nil || !offer.YourIP.Equal(net.IPv4(192, 0, 2, 10)) {
+				t.Fatalf("unexpected offer %#v, %v", offer, err)
+			}
+			if offer.BootFile != "pxelinux.0" {
+				t.Fatalf("wrapper did not set boot file, got %q", offer.BootFile)
+			}
+
+			send := func(mac string, mt dhcpv4.MessageType, mods ...dhcpv4.Modifier) {
+				t.Helper()
+				hw, _ := net.ParseMAC(mac)
+				m, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithHwAddr(hw), dhcpv4.WithMessageType(mt)}, mods...)...)
+				if err != nil {
+					t.Fatalf("build %s: %v", mt, err)
+				}
+				srv.DHCPHandler(&recordingPacketConn{}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 68}, m)
+			}
+
+			// RELEASE reaches the pool and frees .10; .11 is held by the restored lease.
+			send("00:11:22:33:44:01", dhcpv4.MessageTypeRelease, dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 10)))
+			offer, err = allocator.Offer(discoverFrom("00:11:22:33:44:02"))
+			if err != nil || !offer.YourIP.Equal(net.IPv4(192, 0, 2, 10)) {
+				t.Fatalf("expected released address, got %#v, %v", offer, err)
+			}
+
+			// DECLINE reaches the pool and quarantines .10.
+			send("00:11:22:33:44:02", dhcpv4.MessageTypeDecline, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 10))))
+			if _, err := allocator.Offer(discoverFrom("00:11:22:33:44:03")); !errors.Is(err, tftp.ErrPoolExhausted) {
+				t.Fatalf("expected declined and restored addresses to be withheld, got %v", err)
+			}
+		})
+	}
+}
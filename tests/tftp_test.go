@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/opnlaas/tftp"
 )
@@ -31,6 +36,28 @@ func TestParseRRQRequestTFTP(t *testing.T) {
 	}
 }
 
+func TestServerStopReturns(t *testing.T) {
+	srv, err := tftp.NewServer(tftp.Options{ListenAddrTFTP: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop did not return after closing the TFTP listener")
+	}
+}
+
 func TestSendBufferTFTP(t *testing.T) {
 	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
 	if err != nil {
@@ -132,3 +159,953 @@ func TestSendBufferTFTPZeroLength(t *testing.T) {
 		t.Fatalf("expected at least one packet to be sent for empty content")
 	}
 }
+
+func TestParseRequestTFTPOptions(t *testing.T) {
+	buffer := []byte{0, tftp.OPCODE_RRQ}
+	for _, part := range []string{"bootx64.efi", "octet", "BLKSIZE", "1468", "tsize", "0", "dangling"} {
+		buffer = append(buffer, part...)
+		buffer = append(buffer, 0)
+	}
+
+	file, mode, options, err := tftp.ParseRequestTFTP(buffer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if file != "bootx64.efi" || mode != "octet" {
+		t.Fatalf("unexpected file/mode: %q %q", file, mode)
+	}
+
+	if len(options) != 2 || options["blksize"] != "1468" || options["tsize"] != "0" {
+		t.Fatalf("unexpected options: %#v", options)
+	}
+}
+
+func TestTFTPBlockSizeNegotiation(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 250)
+	seen := make(chan *tftp.Context, 1)
+
+	addr := startTFTPServer(t, tftp.Options{
+		MaxBlockSizeTFTP: 1024,
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			seen <- ctx
+			return content, nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "big.bin", "octet", "blksize", "1468")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if oack[1] != tftp.OPCODE_OACK {
+		t.Fatalf("expected OACK, got opcode %d", oack[1])
+	}
+	if got := string(oack[2:]); got != "blksize\x001024\x00" {
+		t.Fatalf("unexpected OACK payload %q", got)
+	}
+
+	ctx := <-seen
+	if ctx.Transfer == nil || ctx.Transfer.BlockSize != 1024 {
+		t.Fatalf("expected getter to see negotiated blksize, got %#v", ctx.Transfer)
+	}
+
+	writeACKTFTP(t, client, dataAddr, 0)
+
+	var received []byte
+	for {
+		packet, _ := readPacketTFTP(t, client)
+		if packet[1] != tftp.OPCODE_DATA {
+			t.Fatalf("expected DATA, got opcode %d", packet[1])
+		}
+		if len(packet)-4 > 1024 {
+			t.Fatalf("block exceeds negotiated size: %d", len(packet)-4)
+		}
+		received = append(received, packet[4:]...)
+		writeACKTFTP(t, client, dataAddr, binary.BigEndian.Uint16(packet[2:4]))
+		if len(packet)-4 < 1024 {
+			break
+		}
+	}
+
+	if !bytes.Equal(received, content) {
+		t.Fatalf("content mismatch: got %d bytes, want %d", len(received), len(content))
+	}
+}
+
+func startTFTPServer(t *testing.T, opts tftp.Options) *net.UDPAddr {
+	t.Helper()
+
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v", err)
+	}
+	addr := probe.LocalAddr().(*net.UDPAddr)
+	_ = probe.Close()
+
+	opts.ListenAddrTFTP = addr.String()
+	srv, err := tftp.NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+
+	return addr
+}
+
+func dialTFTPClient(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatalf("failed to open client conn: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func sendRequestTFTP(t *testing.T, conn *net.UDPConn, addr *net.UDPAddr, opcode byte, parts ...string) {
+	t.Helper()
+
+	packet := []byte{0, opcode}
+	for _, p := range parts {
+		packet = append(packet, p...)
+		packet = append(packet, 0)
+	}
+	if _, err := conn.WriteToUDP(packet, addr); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+}
+
+func readPacketTFTP(t *testing.T, conn *net.UDPConn) ([]byte, *net.UDPAddr) {
+	t.Helper()
+
+	buf := make([]byte, 70000)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	if n < 2 {
+		t.Fatalf("short packet: %d bytes", n)
+	}
+	return buf[:n], addr
+}
+
+func writeACKTFTP(t *testing.T, conn *net.UDPConn, addr *net.UDPAddr, block uint16) {
+	t.Helper()
+
+	ack := []byte{0, tftp.OPCODE_ACK, byte(block >> 8), byte(block)}
+	if _, err := conn.WriteToUDP(ack, addr); err != nil {
+		t.Fatalf("failed to send ack: %v", err)
+	}
+}
+
+type sizedGetter struct {
+	size  int64
+	gets  chan string
+	sizes chan string
+}
+
+func (g *sizedGetter) Get(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+	g.gets <- ctx.Filename
+	return make([]byte, g.size), nil
+}
+
+func (g *sizedGetter) Size(gt tftp.GetType, ctx *tftp.Context) (int64, error) {
+	g.sizes <- ctx.Filename
+	return g.size, nil
+}
+
+func TestTFTPTransferSizeFromContent(t *testing.T) {
+	addr := startTFTPServer(t, tftp.Options{
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			return []byte("hello world"), nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "grubx64.efi", "octet", "tsize", "0")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if oack[1] != tftp.OPCODE_OACK {
+		t.Fatalf("expected OACK, got opcode %d", oack[1])
+	}
+	if got := string(oack[2:]); got != "tsize\x0011\x00" {
+		t.Fatalf("unexpected OACK payload %q", got)
+	}
+
+	writeACKTFTP(t, client, dataAddr, 0)
+
+	data, _ := readPacketTFTP(t, client)
+	if data[1] != tftp.OPCODE_DATA || string(data[4:]) != "hello world" {
+		t.Fatalf("unexpected data packet %q", data)
+	}
+	writeACKTFTP(t, client, dataAddr, 1)
+}
+
+func TestTFTPTransferSizeProbeUsesSizer(t *testing.T) {
+	getter := &sizedGetter{size: 4096, gets: make(chan string, 1), sizes: make(chan string, 1)}
+	addr := startTFTPServer(t, tftp.Options{Getter: getter})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "bootx64.efi", "octet", "tsize", "0", "blksize", "1468")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if got := string(oack[2:]); got != "blksize\x001468\x00tsize\x004096\x00" {
+		t.Fatalf("unexpected OACK payload %q", got)
+	}
+
+	// EDK2 aborts the size probe with error 8 and re-requests later.
+	abort := append([]byte{0, tftp.OPCODE_ERROR, 0, 8}, "tsize probe"...)
+	abort = append(abort, 0)
+	if _, err := client.WriteToUDP(abort, dataAddr); err != nil {
+		t.Fatalf("failed to send abort: %v", err)
+	}
+
+	if name := <-getter.sizes; name != "bootx64.efi" {
+		t.Fatalf("unexpected sizer filename %q", name)
+	}
+
+	select {
+	case name := <-getter.gets:
+		t.Fatalf("expected Get not to be called for an aborted probe, got %q", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSendBufferTFTPAbortsAfterMaxRetries(t *testing.T) {
+	client := dialTFTPClient(t)
+
+	dataConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatalf("failed to open data conn: %v", err)
+	}
+	defer dataConn.Close()
+
+	opts := tftp.TransferOptionsTFTP{Timeout: 50 * time.Millisecond, MaxRetries: 2, Backoff: true}
+	err = tftp.SendBufferWithOptionsTFTP(context.Background(), dataConn, client.LocalAddr().(*net.UDPAddr), []byte("lost"), opts)
+	if !errors.Is(err, tftp.ErrTransferTimeoutTFTP) {
+		t.Fatalf("expected ErrTransferTimeoutTFTP, got %v", err)
+	}
+
+	// One original send plus two retransmits, then an ERROR packet.
+	for i := 0; i < 3; i++ {
+		packet, _ := readPacketTFTP(t, client)
+		if packet[1] != tftp.OPCODE_DATA {
+			t.Fatalf("packet %d: expected DATA, got opcode %d", i, packet[1])
+		}
+	}
+
+	packet, _ := readPacketTFTP(t, client)
+	if packet[1] != tftp.OPCODE_ERROR {
+		t.Fatalf("expected ERROR after retries exhausted, got opcode %d", packet[1])
+	}
+}
+
+func TestTFTPTimeoutOptionNegotiation(t *testing.T) {
+	addr := startTFTPServer(t, tftp.Options{
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			return []byte("x"), nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "ldlinux.c32", "octet", "timeout", "3", "blksize", "1")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if got := string(oack[2:]); got != "timeout\x003\x00" {
+		t.Fatalf("expected only timeout to be acknowledged, got %q", got)
+	}
+
+	writeACKTFTP(t, client, dataAddr, 0)
+	data, _ := readPacketTFTP(t, client)
+	if data[1] != tftp.OPCODE_DATA {
+		t.Fatalf("expected DATA, got opcode %d", data[1])
+	}
+	writeACKTFTP(t, client, dataAddr, 1)
+}
+
+func TestSendBufferTFTPWindowRollback(t *testing.T) {
+	client := dialTFTPClient(t)
+
+	dataConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatalf("failed to open data conn: %v", err)
+	}
+	defer dataConn.Close()
+
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	done := make(chan error, 1)
+	go func() {
+		opts := tftp.TransferOptionsTFTP{BlockSize: 8, WindowSize: 4, Timeout: time.Second}
+		done <- tftp.SendBufferWithOptionsTFTP(context.Background(), dataConn, client.LocalAddr().(*net.UDPAddr), content, opts)
+	}()
+
+	readWindow := func(want ...uint16) map[uint16][]byte {
+		blocks := make(map[uint16][]byte)
+		for _, w := range want {
+			packet, _ := readPacketTFTP(t, client)
+			if got := binary.BigEndian.Uint16(packet[2:4]); packet[1] != tftp.OPCODE_DATA || got != w {
+				t.Fatalf("expected DATA block %d, got opcode %d block %d", w, packet[1], got)
+			}
+			blocks[w] = append([]byte(nil), packet[4:]...)
+		}
+		return blocks
+	}
+
+	serverAddr := dataConn.LocalAddr().(*net.UDPAddr)
+	serverAddr.IP = net.IPv4(127, 0, 0, 1)
+
+	first := readWindow(1, 2, 3, 4)
+	// Pretend block 2 was lost: ACK the last in-order block so the sender rolls back.
+	writeACKTFTP(t, client, serverAddr, 1)
+
+	second := readWindow(2, 3, 4, 5)
+	writeACKTFTP(t, client, serverAddr, 5)
+
+	final := readWindow(6)
+	writeACKTFTP(t, client, serverAddr, 6)
+
+	if err := <-done; err != nil {
+		t.Fatalf("SendBufferWithOptionsTFTP returned error: %v", err)
+	}
+
+	var received []byte
+	received = append(received, first[1]...)
+	for _, b := range []uint16{2, 3, 4, 5} {
+		received = append(received, second[b]...)
+	}
+	received = append(received, final[6]...)
+	if !bytes.Equal(received, content) {
+		t.Fatalf("content mismatch: got %q, want %q", received, content)
+	}
+}
+
+func TestSendBufferTFTPWindowDuplicateACKs(t *testing.T) {
+	client := dialTFTPClient(t)
+
+	dataConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatalf("failed to open data conn: %v", err)
+	}
+	defer dataConn.Close()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 7)
+	done := make(chan error, 1)
+	go func() {
+		opts := tftp.TransferOptionsTFTP{BlockSize: 8, WindowSize: 8, Timeout: time.Second, MaxRetries: 1}
+		done <- tftp.SendBufferWithOptionsTFTP(context.Background(), dataConn, client.LocalAddr().(*net.UDPAddr), content, opts)
+	}()
+
+	serverAddr := dataConn.LocalAddr().(*net.UDPAddr)
+	serverAddr.IP = net.IPv4(127, 0, 0, 1)
+
+	// Behave like receiveTFTP: drop block 2 once, then ACK the last in-order block for
+	// every out-of-order block, so the sender sees a burst of duplicate ACKs.
+	var received []byte
+	expected, sinceACK, dropped := uint16(1), 0, false
+	for {
+		packet, _ := readPacketTFTP(t, client)
+		if packet[1] != tftp.OPCODE_DATA {
+			t.Fatalf("expected DATA, got %v", packet)
+		}
+		block := binary.BigEndian.Uint16(packet[2:4])
+		if block == 2 && !dropped {
+			dropped = true
+			continue
+		}
+		if block != expected {
+			writeACKTFTP(t, client, serverAddr, expected-1)
+			sinceACK = 0
+			continue
+		}
+
+		received = append(received, packet[4:]...)
+		expected++
+		sinceACK++
+		if len(packet) < 4+8 {
+			writeACKTFTP(t, client, serverAddr, block)
+			break
+		}
+		if sinceACK == 8 {
+			writeACKTFTP(t, client, serverAddr, block)
+			sinceACK = 0
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("SendBufferWithOptionsTFTP returned error: %v", err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("content mismatch: got %q, want %q", received, content)
+	}
+}
+
+func TestTFTPWindowSizeNegotiationCapped(t *testing.T) {
+	addr := startTFTPServer(t, tftp.Options{
+		MaxWindowSizeTFTP: 8,
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			return []byte("x"), nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "undionly.kpxe", "octet", "windowsize", "16")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if got := string(oack[2:]); got != "windowsize\x008\x00" {
+		t.Fatalf("unexpected OACK payload %q", got)
+	}
+
+	writeACKTFTP(t, client, dataAddr, 0)
+	data, _ := readPacketTFTP(t, client)
+	if data[1] != tftp.OPCODE_DATA {
+		t.Fatalf("expected DATA, got opcode %d", data[1])
+	}
+	writeACKTFTP(t, client, dataAddr, 1)
+}
+
+func TestSendBufferTFTPBlockRollover(t *testing.T) {
+	content := make([]byte, 33<<20)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name     string
+		rollover tftp.RolloverMode
+		wrapTo   uint16
+	}{
+		{name: "wrap to zero", rollover: tftp.RolloverToZero, wrapTo: 0},
+		{name: "wrap to one", rollover: tftp.RolloverToOne, wrapTo: 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			const window = 8
+			client := dialTFTPClient(t)
+
+			dataConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+			if err != nil {
+				t.Fatalf("failed to open data conn: %v", err)
+			}
+			defer dataConn.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				opts := tftp.TransferOptionsTFTP{WindowSize: window, Rollover: tt.rollover}
+				done <- tftp.SendBufferWithOptionsTFTP(context.Background(), dataConn, client.LocalAddr().(*net.UDPAddr), content, opts)
+			}()
+
+			received := make([]byte, 0, len(content))
+			expected := uint16(1)
+			sawWrap := false
+			for count := 1; ; count++ {
+				packet, addr := readPacketTFTP(t, client)
+				block := binary.BigEndian.Uint16(packet[2:4])
+				if packet[1] != tftp.OPCODE_DATA || block != expected {
+					t.Fatalf("packet %d: expected DATA block %d, got opcode %d block %d", count, expected, packet[1], block)
+				}
+				received = append(received, packet[4:]...)
+
+				last := len(packet)-4 < tftp.BLOCK_SIZE
+				if count%window == 0 || last {
+					writeACKTFTP(t, client, addr, block)
+				}
+				if last {
+					break
+				}
+
+				expected++
+				if expected == 0 {
+					sawWrap = true
+					expected = tt.wrapTo
+				}
+			}
+
+			if err := <-done; err != nil {
+				t.Fatalf("SendBufferWithOptionsTFTP returned error: %v", err)
+			}
+			if !sawWrap {
+				t.Fatalf("expected block numbers to roll over")
+			}
+			if !bytes.Equal(received, content) {
+				t.Fatalf("content mismatch after rollover: got %d bytes, want %d", len(received), len(content))
+			}
+		})
+	}
+}
+
+func TestTFTPRolloverOptionNegotiation(t *testing.T) {
+	seen := make(chan *tftp.Context, 1)
+	addr := startTFTPServer(t, tftp.Options{
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			seen <- ctx
+			return []byte("x"), nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "vmlinuz", "octet", "rollover", "1")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if got := string(oack[2:]); got != "rollover\x001\x00" {
+		t.Fatalf("unexpected OACK payload %q", got)
+	}
+	if ctx := <-seen; ctx.Transfer.Rollover != tftp.RolloverToOne {
+		t.Fatalf("expected RolloverToOne, got %v", ctx.Transfer.Rollover)
+	}
+
+	writeACKTFTP(t, client, dataAddr, 0)
+	readPacketTFTP(t, client)
+	writeACKTFTP(t, client, dataAddr, 1)
+}
+
+func TestTFTPWriteRequestUsesPutter(t *testing.T) {
+	type upload struct {
+		ctx  *tftp.Context
+		data []byte
+	}
+	uploads := make(chan upload, 1)
+
+	addr := startTFTPServer(t, tftp.Options{
+		Putter: tftp.PutterFunc(func(gt tftp.GetType, ctx *tftp.Context, reader io.Reader) error {
+			data, err := io.ReadAll(reader)
+			uploads <- upload{ctx: ctx, data: data}
+			return err
+		}),
+	})
+
+	content := []byte("hostname switch-01\ninterface eth0\n")
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_WRQ, "backups/switch-01.cfg", "octet", "blksize", "16")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if got := string(oack[2:]); oack[1] != tftp.OPCODE_OACK || got != "blksize\x0016\x00" {
+		t.Fatalf("unexpected OACK %q", oack)
+	}
+
+	for block, offset := uint16(1), 0; ; block++ {
+		end := offset + 16
+		if end > len(content) {
+			end = len(content)
+		}
+		packet := append([]byte{0, tftp.OPCODE_DATA, byte(block >> 8), byte(block)}, content[offset:end]...)
+		if _, err := client.WriteToUDP(packet, dataAddr); err != nil {
+			t.Fatalf("failed to send data: %v", err)
+		}
+
+		ack, _ := readPacketTFTP(t, client)
+		if ack[1] != tftp.OPCODE_ACK || binary.BigEndian.Uint16(ack[2:4]) != block {
+			t.Fatalf("expected ACK %d, got %v", block, ack)
+		}
+
+		if end-offset < 16 {
+			break
+		}
+		offset = end
+	}
+
+	got := <-uploads
+	if got.ctx.Filename != "backups/switch-01.cfg" || got.ctx.Transfer.BlockSize != 16 {
+		t.Fatalf("unexpected put context: %#v", got.ctx)
+	}
+	if !bytes.Equal(got.data, content) {
+		t.Fatalf("content mismatch: got %q, want %q", got.data, content)
+	}
+}
+
+func TestTFTPWriteRequestIgnoresUnknownTID(t *testing.T) {
+	uploads := make(chan []byte, 1)
+	addr := startTFTPServer(t, tftp.Options{
+		Putter: tftp.PutterFunc(func(gt tftp.GetType, ctx *tftp.Context, reader io.Reader) error {
+			data, err := io.ReadAll(reader)
+			uploads <- data
+			return err
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_WRQ, "config.txt", "octet")
+
+	ack, dataAddr := readPacketTFTP(t, client)
+	if ack[1] != tftp.OPCODE_ACK || binary.BigEndian.Uint16(ack[2:4]) != 0 {
+		t.Fatalf("expected ACK 0, got %v", ack)
+	}
+
+	// A second host finds the data port and tries to complete the upload first.
+	stranger := dialTFTPClient(t)
+	if _, err := stranger.WriteToUDP([]byte{0, tftp.OPCODE_DATA, 0, 1, 'e', 'v', 'i', 'l'}, dataAddr); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	packet, _ := readPacketTFTP(t, stranger)
+	if packet[1] != tftp.OPCODE_ERROR || packet[3] != 5 {
+		t.Fatalf("expected ERROR code 5 for stranger, got %v", packet)
+	}
+
+	if _, err := client.WriteToUDP([]byte{0, tftp.OPCODE_DATA, 0, 1, 'o', 'k'}, dataAddr); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	ack, _ = readPacketTFTP(t, client)
+	if ack[1] != tftp.OPCODE_ACK || binary.BigEndian.Uint16(ack[2:4]) != 1 {
+		t.Fatalf("expected ACK 1, got %v", ack)
+	}
+
+	if got := <-uploads; string(got) != "ok" {
+		t.Fatalf("upload content = %q, want %q", got, "ok")
+	}
+}
+
+func TestTFTPWriteRequestACKsGapOnce(t *testing.T) {
+	uploads := make(chan []byte, 1)
+	addr := startTFTPServer(t, tftp.Options{
+		Putter: tftp.PutterFunc(func(gt tftp.GetType, ctx *tftp.Context, reader io.Reader) error {
+			data, err := io.ReadAll(reader)
+			uploads <- data
+			return err
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_WRQ, "dump.bin", "octet", "blksize", "8", "windowsize", "4")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if oack[1] != tftp.OPCODE_OACK {
+		t.Fatalf("expected OACK, got %v", oack)
+	}
+
+	content := []byte("0123456789abcdefghijklmnopqrstuv!")
+	sendBlock := func(block uint16) {
+		t.Helper()
+		start := int(block-1) * 8
+		end := min(start+8, len(content))
+		packet := append([]byte{0, tftp.OPCODE_DATA, byte(block >> 8), byte(block)}, content[start:end]...)
+		if _, err := client.WriteToUDP(packet, dataAddr); err != nil {
+			t.Fatalf("failed to send data: %v", err)
+		}
+	}
+
+	// Block 2 is lost: the rest of the window gets a single ACK 1, not one per block.
+	sendBlock(1)
+	sendBlock(3)
+	sendBlock(4)
+	ack, _ := readPacketTFTP(t, client)
+	if ack[1] != tftp.OPCODE_ACK || binary.BigEndian.Uint16(ack[2:4]) != 1 {
+		t.Fatalf("expected ACK 1, got %v", ack)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, _, err := client.ReadFromUDP(make([]byte, 16)); err == nil {
+		t.Fatalf("expected one ACK for the gap, got another %d-byte packet", n)
+	}
+
+	for _, block := range []uint16{2, 3, 4, 5} {
+		sendBlock(block)
+	}
+	ack, _ = readPacketTFTP(t, client)
+	if ack[1] != tftp.OPCODE_ACK || binary.BigEndian.Uint16(ack[2:4]) != 5 {
+		t.Fatalf("expected ACK 5, got %v", ack)
+	}
+
+	if got := <-uploads; !bytes.Equal(got, content) {
+		t.Fatalf("upload content = %q, want %q", got, content)
+	}
+}
+
+func TestTFTPWriteRequestRejectsOversizedUpload(t *testing.T) {
+	addr := startTFTPServer(t, tftp.Options{
+		MaxWriteSizeTFTP: 1024,
+		Putter: tftp.PutterFunc(func(gt tftp.GetType, ctx *tftp.Context, reader io.Reader) error {
+			t.Errorf("putter should not be called for oversized uploads")
+			return nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_WRQ, "crash.dump", "octet", "tsize", "4096")
+
+	packet, _ := readPacketTFTP(t, client)
+	if packet[1] != tftp.OPCODE_ERROR || packet[3] != 3 {
+		t.Fatalf("expected ERROR code 3, got %v", packet)
+	}
+}
+
+func TestTFTPWriteRequestWithoutPutter(t *testing.T) {
+	addr := startTFTPServer(t, tftp.Options{})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_WRQ, "upload.bin", "octet")
+
+	packet, _ := readPacketTFTP(t, client)
+	if packet[1] != tftp.OPCODE_ERROR || packet[3] != 4 {
+		t.Fatalf("expected ERROR code 4, got %v", packet)
+	}
+}
+
+type closeTracker struct {
+	*bytes.Reader
+	closed chan struct{}
+}
+
+func (c *closeTracker) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestTFTPStreamGetter(t *testing.T) {
+	content := bytes.Repeat([]byte("squashfs"), 300)
+	tracker := &closeTracker{Reader: bytes.NewReader(content), closed: make(chan struct{})}
+
+	addr := startTFTPServer(t, tftp.Options{
+		Getter: tftp.StreamGetterFunc(func(gt tftp.GetType, ctx *tftp.Context) (*tftp.Artifact, error) {
+			return &tftp.Artifact{Content: tracker, Size: int64(len(content))}, nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "rootfs.squashfs", "octet", "tsize", "0", "windowsize", "2")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if got := string(oack[2:]); got != "windowsize\x002\x00tsize\x002400\x00" {
+		t.Fatalf("unexpected OACK payload %q", got)
+	}
+	writeACKTFTP(t, client, dataAddr, 0)
+
+	var received []byte
+	for {
+		packet, _ := readPacketTFTP(t, client)
+		block := binary.BigEndian.Uint16(packet[2:4])
+		received = append(received, packet[4:]...)
+		last := len(packet)-4 < tftp.BLOCK_SIZE
+		if block%2 == 0 || last {
+			writeACKTFTP(t, client, dataAddr, block)
+		}
+		if last {
+			break
+		}
+	}
+
+	if !bytes.Equal(received, content) {
+		t.Fatalf("content mismatch: got %d bytes, want %d", len(received), len(content))
+	}
+
+	select {
+	case <-tracker.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected artifact to be closed after transfer")
+	}
+}
+
+func TestStreamGetterFuncGetReadsWholeStream(t *testing.T) {
+	getter := tftp.StreamGetterFunc(func(gt tftp.GetType, ctx *tftp.Context) (*tftp.Artifact, error) {
+		return tftp.NewArtifact([]byte("initrd")), nil
+	})
+
+	content, err := getter.Get(tftp.GetTypeTFTP, &tftp.Context{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(content) != "initrd" {
+		t.Fatalf("unexpected content %q", content)
+	}
+}
+
+func TestTFTPContextCancelledAfterTransfer(t *testing.T) {
+	seen := make(chan *tftp.Context, 1)
+	addr := startTFTPServer(t, tftp.Options{
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			if err := ctx.Context().Err(); err != nil {
+				t.Errorf("context cancelled before transfer: %v", err)
+			}
+			seen <- ctx
+			return []byte("x"), nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "pxelinux.cfg/default", "octet")
+
+	data, dataAddr := readPacketTFTP(t, client)
+	if data[1] != tftp.OPCODE_DATA {
+		t.Fatalf("expected DATA, got opcode %d", data[1])
+	}
+	writeACKTFTP(t, client, dataAddr, 1)
+
+	ctx := <-seen
+	select {
+	case <-ctx.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected transfer context to be cancelled once the transfer ended")
+	}
+}
+
+func TestTFTPMapsGetterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		expose bool
+		code   byte
+		msg    string
+	}{
+		{name: "not found", err: tftp.ErrNotFound, code: tftp.ERROR_FILE_NOT_FOUND, msg: "File not found"},
+		{name: "access denied", err: fmt.Errorf("host locked: %w", tftp.ErrAccessDenied), code: tftp.ERROR_ACCESS_VIOLATION, msg: "Access violation"},
+		{name: "disk full", err: tftp.ErrDiskFull, code: tftp.ERROR_DISK_FULL, msg: "Disk full or allocation exceeded"},
+		{name: "unavailable", err: tftp.ErrUnavailable, code: tftp.ERROR_UNDEFINED, msg: "Temporarily unavailable"},
+		{name: "unclassified hidden", err: errors.New("sql: connection refused"), code: tftp.ERROR_FILE_NOT_FOUND, msg: "File not found"},
+		{name: "unclassified exposed", err: errors.New("no profile"), expose: true, code: tftp.ERROR_FILE_NOT_FOUND, msg: "no profile"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startTFTPServer(t, tftp.Options{
+				ExposeErrors: tt.expose,
+				Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+					return nil, tt.err
+				}),
+			})
+
+			client := dialTFTPClient(t)
+			sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "pxelinux.0", "octet")
+
+			packet, _ := readPacketTFTP(t, client)
+			if packet[1] != tftp.OPCODE_ERROR || packet[3] != tt.code {
+				t.Fatalf("expected ERROR code %d, got %v", tt.code, packet)
+			}
+			if got := string(bytes.TrimRight(packet[4:], "\x00")); got != tt.msg {
+				t.Fatalf("unexpected error message %q, want %q", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestTFTPNetasciiRead(t *testing.T) {
+	seen := make(chan *tftp.Context, 1)
+	addr := startTFTPServer(t, tftp.Options{
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			seen <- ctx
+			return []byte("hostname r1\nend\n"), nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "r1.cfg", "NetASCII", "tsize", "0")
+
+	oack, dataAddr := readPacketTFTP(t, client)
+	if got := string(oack[2:]); got != "tsize\x0018\x00" {
+		t.Fatalf("unexpected OACK payload %q", got)
+	}
+	if ctx := <-seen; ctx.Transfer.Mode != tftp.MODE_NETASCII {
+		t.Fatalf("expected netascii mode in context, got %q", ctx.Transfer.Mode)
+	}
+
+	writeACKTFTP(t, client, dataAddr, 0)
+	data, _ := readPacketTFTP(t, client)
+	if got := string(data[4:]); got != "hostname r1\r\nend\r\n" {
+		t.Fatalf("unexpected netascii payload %q", got)
+	}
+	writeACKTFTP(t, client, dataAddr, 1)
+}
+
+func TestTFTPNetasciiWrite(t *testing.T) {
+	uploads := make(chan []byte, 1)
+	addr := startTFTPServer(t, tftp.Options{
+		Putter: tftp.PutterFunc(func(gt tftp.GetType, ctx *tftp.Context, reader io.Reader) error {
+			data, err := io.ReadAll(reader)
+			uploads <- data
+			return err
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_WRQ, "r1.cfg", "netascii")
+
+	ack, dataAddr := readPacketTFTP(t, client)
+	if ack[1] != tftp.OPCODE_ACK {
+		t.Fatalf("expected ACK 0, got %v", ack)
+	}
+
+	packet := append([]byte{0, tftp.OPCODE_DATA, 0, 1}, "banner\r\x00x\r\nend\r\n"...)
+	if _, err := client.WriteToUDP(packet, dataAddr); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	readPacketTFTP(t, client)
+
+	if got := string(<-uploads); got != "banner\rx\nend\n" {
+		t.Fatalf("unexpected decoded upload %q", got)
+	}
+}
+
+func TestTFTPRejectsUnknownMode(t *testing.T) {
+	addr := startTFTPServer(t, tftp.Options{
+		Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+			return []byte("x"), nil
+		}),
+	})
+
+	client := dialTFTPClient(t)
+	sendRequestTFTP(t, client, addr, tftp.OPCODE_RRQ, "root", "mail")
+
+	packet, _ := readPacketTFTP(t, client)
+	if packet[1] != tftp.OPCODE_ERROR || packet[3] != tftp.ERROR_ILLEGAL_OPERATION {
+		t.Fatalf("expected ERROR code 4, got %v", packet)
+	}
+}
+
+func TestTFTPOverIPv6(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string
+		client string
+		dial   net.IP
+	}{
+		{name: "ipv6 loopback", listen: "::1", client: "udp6", dial: net.IPv6loopback},
+		{name: "dual-stack ipv6 client", listen: "::", client: "udp6", dial: net.IPv6loopback},
+		{name: "dual-stack ipv4 client", listen: "::", client: "udp4", dial: net.IPv4(127, 0, 0, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+			if err != nil {
+				t.Skipf("IPv6 loopback unavailable: %v", err)
+			}
+			port := probe.LocalAddr().(*net.UDPAddr).Port
+			_ = probe.Close()
+
+			srv, err := tftp.NewServer(tftp.Options{
+				ListenAddrTFTP: net.JoinHostPort(tt.listen, strconv.Itoa(port)),
+				Getter: tftp.GetterFunc(func(gt tftp.GetType, ctx *tftp.Context) ([]byte, error) {
+					return []byte("hello " + *ctx.From.IPAddress), nil
+				}),
+			})
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			if err := srv.Start(); err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+			t.Cleanup(srv.Stop)
+
+			client, err := net.ListenUDP(tt.client, &net.UDPAddr{IP: tt.dial})
+			if err != nil {
+				t.Fatalf("failed to open client conn: %v", err)
+			}
+			t.Cleanup(func() { _ = client.Close() })
+
+			sendRequestTFTP(t, client, &net.UDPAddr{IP: tt.dial, Port: port}, tftp.OPCODE_RRQ, "ipxe.efi", "octet")
+
+			data, dataAddr := readPacketTFTP(t, client)
+			if want := "hello " + tt.dial.String(); data[1] != tftp.OPCODE_DATA || string(data[4:]) != want {
+				t.Fatalf("unexpected data packet %q, want %q", data, want)
+			}
+			if !dataAddr.IP.Equal(tt.dial) {
+				t.Fatalf("data sent from %v, want %v", dataAddr.IP, tt.dial)
+			}
+			writeACKTFTP(t, client, dataAddr, 1)
+		})
+	}
+}
@@ -1,12 +1,25 @@
 package tftp
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrTransferTimeoutTFTP is returned when a client stops acknowledging and the retry limit is hit.
+	ErrTransferTimeoutTFTP = errors.New("tftp transfer timed out")
+	// ErrTransferTooLargeTFTP is returned when an upload exceeds the configured size limit.
+	ErrTransferTooLargeTFTP = errors.New("tftp transfer exceeds size limit")
+)
+
 func sendErrorTFTP(conn *net.UDPConn, addr *net.UDPAddr, errCode int, errMsg string) (err error) {
 	var buffer []byte = make([]byte, 5+len(errMsg))
 
@@ -21,7 +34,36 @@ func sendErrorTFTP(conn *net.UDPConn, addr *net.UDPAddr, errCode int, errMsg str
 	return
 }
 
+// fromPeerTFTP reports whether a packet read on a transfer socket came from the client's
+// TID. Packets from anywhere else are answered with error 5 (RFC 1350 section 4) and
+// must be ignored so a stranger cannot inject or abort transfer data.
+func fromPeerTFTP(conn *net.UDPConn, addr, src *net.UDPAddr) bool {
+	if src.Port == addr.Port && src.IP.Equal(addr.IP) {
+		return true
+	}
+	_ = sendErrorTFTP(conn, src, ERROR_UNKNOWN_TID, "Unknown transfer ID")
+	return false
+}
+
 func ParseRRQRequestTFTP(buffer []byte) (file string, mode string, err error) {
+	file, mode, _, err = ParseRequestTFTP(buffer)
+	return
+}
+
+// normalizeModeTFTP lower-cases a request's transfer mode and reports whether it is one
+// the server implements. The obsolete "mail" mode is refused like any unknown mode.
+func normalizeModeTFTP(mode string) (string, bool) {
+	mode = strings.ToLower(mode)
+	switch mode {
+	case MODE_OCTET, MODE_NETASCII:
+		return mode, true
+	}
+	return mode, false
+}
+
+// ParseRequestTFTP splits a request packet into filename, mode, and any RFC 2347 options.
+// Option names are lower-cased; a trailing name without a value is dropped.
+func ParseRequestTFTP(buffer []byte) (file string, mode string, options map[string]string, err error) {
 	var (
 		start int      = 2
 		parts []string = make([]string, 0)
@@ -41,65 +83,500 @@ func ParseRRQRequestTFTP(buffer []byte) (file string, mode string, err error) {
 
 	file = parts[0]
 	mode = parts[1]
+
+	options = make(map[string]string)
+	for i := 2; i+1 < len(parts); i += 2 {
+		options[strings.ToLower(parts[i])] = parts[i+1]
+	}
 	return
 }
 
-func SendBufferTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, content []byte) error {
-	blockNum := uint16(1)
-	offset := 0
+func buildOACKTFTP(pairs []string) []byte {
+	packet := []byte{0, OPCODE_OACK}
+	for _, p := range pairs {
+		packet = append(packet, p...)
+		packet = append(packet, 0)
+	}
+	return packet
+}
+
+// SendOACKTFTP acknowledges negotiated options and waits for the client's ACK of block 0.
+// pairs alternates option names and values in the order they should appear on the wire.
+func SendOACKTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, pairs []string, opts TransferOptionsTFTP) error {
+	packet := buildOACKTFTP(pairs)
+	resend := func() error {
+		_, err := conn.WriteToUDP(packet, addr)
+		return err
+	}
+
+	if err := resend(); err != nil {
+		return err
+	}
+
+	// The OACK is a window of one, so a stale ACK never counts as a rollback.
+	opts = opts.withDefaults()
+	opts.WindowSize = 1
+	_, err := awaitACKTFTP(ctx, conn, addr, opts, -1, 0, resend)
+	return err
+}
+
+// awaitACKTFTP waits for the client to acknowledge a block in (acked, last] and returns
+// its absolute number. Timeouts call resend. With a window larger than one, an ACK of
+// acked itself means the next block was lost: the window is resent once, and further
+// duplicates (one per out-of-order block) are ignored until the timer fires. Only
+// timeouts count toward opts.MaxRetries. An ERROR packet from the client aborts the
+// exchange, as does exhausting opts.MaxRetries, in which case the client is told via an
+// ERROR packet.
+func awaitACKTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, opts TransferOptionsTFTP, acked, last int64, resend func() error) (int64, error) {
+	reply := make([]byte, 516)
+	interval := opts.Timeout
+	retries := 0
+	deadline := time.Now().Add(interval)
+	rolledBack := false
+
+	retransmit := func() error {
+		if retries >= opts.MaxRetries {
+			_ = sendErrorTFTP(conn, addr, ERROR_UNDEFINED, "Transfer timed out")
+			return ErrTransferTimeoutTFTP
+		}
+		retries++
 
-	// A zero-length file still requires a single data/ack exchange.
-	if len(content) == 0 {
-		content = []byte{}
+		if opts.Backoff {
+			interval *= 2
+			if interval > MAX_RETRANSMIT_INTERVAL {
+				interval = MAX_RETRANSMIT_INTERVAL
+			}
+		}
+
+		if err := resend(); err != nil {
+			return err
+		}
+		deadline = time.Now().Add(interval)
+		return nil
 	}
 
 	for {
-		chunkEnd := offset + BLOCK_SIZE
-		if chunkEnd > len(content) {
-			chunkEnd = len(content)
+		_ = conn.SetReadDeadline(deadline)
+		n, src, err := conn.ReadFromUDP(reply)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				select {
+				case <-ctx.Done():
+					return 0, ctx.Err()
+				default:
+				}
+
+				if err := retransmit(); err != nil {
+					return 0, err
+				}
+				rolledBack = false
+				continue
+			}
+			return 0, err
+		}
+
+		if !fromPeerTFTP(conn, addr, src) || n < 4 {
+			continue
+		}
+
+		switch reply[1] {
+		case OPCODE_ACK:
+			block := opts.Rollover.absolute(binary.BigEndian.Uint16(reply[2:4]), last)
+			switch {
+			case block > acked:
+				return block, nil
+			case block == acked && opts.WindowSize > 1 && !rolledBack:
+				rolledBack = true
+				if err := resend(); err != nil {
+					return 0, err
+				}
+				deadline = time.Now().Add(interval)
+			}
+		case OPCODE_ERROR:
+			return 0, fmt.Errorf("client aborted transfer: %s", parseErrorMessageTFTP(reply[:n]))
+		}
+	}
+}
+
+// wire maps an absolute block number onto the 16-bit block field, wrapping past 65535
+// to either 0 or 1.
+func (r RolloverMode) wire(block int64) uint16 {
+	if r == RolloverToOne && block > 0 {
+		return uint16((block-1)%65535 + 1)
+	}
+	return uint16(block)
+}
+
+// absolute resolves a 16-bit block number from an ACK to the most recent absolute block
+// at or before last that carries it. Numbers that cannot occur under r return -1.
+func (r RolloverMode) absolute(wire uint16, last int64) int64 {
+	if r == RolloverToOne && last > 0 {
+		if wire == 0 {
+			return -1
+		}
+		distance := (int64(r.wire(last)) - int64(wire) + 65535) % 65535
+		return last - distance
+	}
+
+	// Walk back from the newest outstanding block to find which one was ACKed.
+	return last - int64(r.wire(last)-wire)
+}
+
+func parseErrorMessageTFTP(packet []byte) string {
+	if len(packet) <= 4 {
+		return ""
+	}
+	msg := packet[4:]
+	if i := bytes.IndexByte(msg, 0); i >= 0 {
+		msg = msg[:i]
+	}
+	return string(msg)
+}
+
+func SendBufferTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, content []byte) error {
+	return SendBufferWithOptionsTFTP(ctx, conn, addr, content, TransferOptionsTFTP{})
+}
+
+// SendBufferWithOptionsTFTP streams content using already-negotiated transfer options.
+func SendBufferWithOptionsTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, content []byte, opts TransferOptionsTFTP) error {
+	return SendStreamTFTP(ctx, conn, addr, bytes.NewReader(content), opts)
+}
+
+// SendStreamTFTP sends content from its current offset using already-negotiated transfer
+// options. Zero-valued options fall back to BLOCK_SIZE, DEFAULT_TIMEOUT, DEFAULT_MAX_RETRIES
+// and a window of one block (lock-step). With a larger window (RFC 7440) up to WindowSize
+// blocks are in flight and the sender seeks back to the last acknowledged block on loss, so
+// only one block is ever held in memory.
+func SendStreamTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, content io.ReadSeeker, opts TransferOptionsTFTP) error {
+	opts = opts.withDefaults()
+	blockSize := int64(opts.BlockSize)
+
+	if opts.Mode == MODE_NETASCII {
+		encoder, err := newNetasciiEncoder(content)
+		if err != nil {
+			return err
 		}
+		content = encoder
+	}
+
+	base, err := content.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
 
-		chunk := content[offset:chunkEnd]
-		packet := make([]byte, 4+len(chunk))
-		packet[0] = 0
-		packet[1] = OPCODE_DATA
-		packet[2] = byte(blockNum >> 8)
-		packet[3] = byte(blockNum)
-		copy(packet[4:], chunk)
+	packet := make([]byte, 4+blockSize)
+	packet[1] = OPCODE_DATA
+
+	acked := int64(0)
+	final := int64(-1) // the short last block, once it has been read
+
+	// sendWindow (re)sends blocks acked+1 onward and returns the last one sent. A zero-length
+	// file (or an exact multiple of the block size) still ends with a short, possibly empty,
+	// final block.
+	sendWindow := func() (int64, error) {
+		if _, err := content.Seek(base+acked*blockSize, io.SeekStart); err != nil {
+			return 0, err
+		}
+
+		last := acked
+		for last < acked+int64(opts.WindowSize) {
+			last++
+
+			n, err := io.ReadFull(content, packet[4:])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				_ = sendErrorTFTP(conn, addr, ERROR_UNDEFINED, "Read error")
+				return 0, err
+			}
+
+			binary.BigEndian.PutUint16(packet[2:4], opts.Rollover.wire(last))
+			if _, err := conn.WriteToUDP(packet[:4+n], addr); err != nil {
+				return 0, err
+			}
 
-		if _, err := conn.WriteToUDP(packet, addr); err != nil {
+			if int64(n) < blockSize {
+				final = last
+				break
+			}
+		}
+
+		return last, nil
+	}
+
+	for final < 0 || acked < final {
+		last, err := sendWindow()
+		if err != nil {
 			return err
 		}
 
-		ack := make([]byte, 4)
-		for {
-			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-			if _, _, err := conn.ReadFromUDP(ack); err != nil {
-				if ne, ok := err.(net.Error); ok && ne.Timeout() {
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					default:
-						// resend last packet on timeout
-						if _, err := conn.WriteToUDP(packet, addr); err != nil {
-							return err
-						}
-						continue
+		resend := func() error {
+			_, err := sendWindow()
+			return err
+		}
+
+		block, err := awaitACKTFTP(ctx, conn, addr, opts, acked, last, resend)
+		if err != nil {
+			return err
+		}
+		acked = block
+	}
+
+	return nil
+}
+
+// ReceiveTFTP accepts an upload after a bare WRQ: it ACKs block 0 and writes each DATA
+// block to w until a short final block arrives.
+func ReceiveTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, w io.Writer, opts TransferOptionsTFTP) error {
+	fail := func(err error) {
+		code, msg := tftpErrorFor(err, ERROR_UNDEFINED, false)
+		_ = sendErrorTFTP(conn, addr, code, msg)
+	}
+	return receiveTFTP(ctx, conn, addr, w, []byte{0, OPCODE_ACK, 0, 0}, opts, 0, nil, fail)
+}
+
+// receiveTFTP sends first (an OACK or ACK 0) and then collects DATA blocks into w, acking
+// every WindowSize blocks. The first duplicate or out-of-order block after in-order data
+// re-ACKs the last in-order block; the rest of that window is ignored so the sender rolls
+// back only once, and timeouts re-ACK again. maxSize > 0 aborts with error 3 once exceeded. finish, when set, runs
+// after the last block is written but before it is acknowledged so the client learns
+// whether the upload was stored; fail reports write and finish errors to the client.
+func receiveTFTP(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, w io.Writer, first []byte, opts TransferOptionsTFTP, maxSize int64, finish func() error, fail func(error)) error {
+	opts = opts.withDefaults()
+
+	var decoder *netasciiDecoder
+	if opts.Mode == MODE_NETASCII {
+		decoder = &netasciiDecoder{w: w}
+		w = decoder
+	}
+
+	ackPacket := func(block int64) []byte {
+		packet := []byte{0, OPCODE_ACK, 0, 0}
+		binary.BigEndian.PutUint16(packet[2:4], opts.Rollover.wire(block))
+		return packet
+	}
+
+	reply := first
+	if _, err := conn.WriteToUDP(reply, addr); err != nil {
+		return err
+	}
+
+	buf := make([]byte, opts.BlockSize+4)
+	expected := int64(1)
+	written := int64(0)
+	sinceACK := 0
+	gapACKed := false
+	interval := opts.Timeout
+	retries := 0
+	deadline := time.Now().Add(interval)
+
+	for {
+		_ = conn.SetReadDeadline(deadline)
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				default:
+				}
+
+				if retries >= opts.MaxRetries {
+					_ = sendErrorTFTP(conn, addr, ERROR_UNDEFINED, "Transfer timed out")
+					return ErrTransferTimeoutTFTP
+				}
+				retries++
+
+				if opts.Backoff {
+					interval *= 2
+					if interval > MAX_RETRANSMIT_INTERVAL {
+						interval = MAX_RETRANSMIT_INTERVAL
 					}
 				}
-				return err
+
+				if expected > 1 {
+					reply = ackPacket(expected - 1)
+				}
+				if _, err := conn.WriteToUDP(reply, addr); err != nil {
+					return err
+				}
+				sinceACK = 0
+				gapACKed = false
+				deadline = time.Now().Add(interval)
+				continue
 			}
+			return err
+		}
 
-			if ack[1] == OPCODE_ACK && ack[2] == byte(blockNum>>8) && ack[3] == byte(blockNum) {
-				break
+		if !fromPeerTFTP(conn, addr, src) || n < 4 {
+			continue
+		}
+
+		switch buf[1] {
+		case OPCODE_ERROR:
+			return fmt.Errorf("client aborted transfer: %s", parseErrorMessageTFTP(buf[:n]))
+		case OPCODE_DATA:
+		default:
+			continue
+		}
+
+		if block := opts.Rollover.absolute(binary.BigEndian.Uint16(buf[2:4]), expected); block != expected {
+			// Tell the sender where to restart its window (RFC 7440 section 4), once.
+			if gapACKed {
+				continue
 			}
+			gapACKed = true
+			if expected > 1 {
+				reply = ackPacket(expected - 1)
+			}
+			if _, err := conn.WriteToUDP(reply, addr); err != nil {
+				return err
+			}
+			sinceACK = 0
+			continue
+		}
+
+		data := buf[4:n]
+		written += int64(len(data))
+		if maxSize > 0 && written > maxSize {
+			_ = sendErrorTFTP(conn, addr, ERROR_DISK_FULL, "Disk full or allocation exceeded")
+			return ErrTransferTooLargeTFTP
 		}
 
-		offset = chunkEnd
-		if offset >= len(content) && len(chunk) < BLOCK_SIZE {
+		if _, err := w.Write(data); err != nil {
+			fail(err)
+			return err
+		}
+
+		retries = 0
+		gapACKed = false
+		interval = opts.Timeout
+		deadline = time.Now().Add(interval)
+
+		if len(data) < opts.BlockSize {
+			if decoder != nil {
+				if err := decoder.Flush(); err != nil {
+					fail(err)
+					return err
+				}
+			}
+			if finish != nil {
+				if err := finish(); err != nil {
+					fail(err)
+					return err
+				}
+			}
+
+			reply = ackPacket(expected)
+			if _, err := conn.WriteToUDP(reply, addr); err != nil {
+				return err
+			}
+			dallyTFTP(conn, addr, reply, opts.Timeout)
 			return nil
 		}
 
-		blockNum++
+		sinceACK++
+		if sinceACK >= opts.WindowSize {
+			reply = ackPacket(expected)
+			if _, err := conn.WriteToUDP(reply, addr); err != nil {
+				return err
+			}
+			sinceACK = 0
+		}
+
+		expected++
+	}
+}
+
+// dallyTFTP lingers after the final ACK so a retransmitted last block (our ACK was lost)
+// is acknowledged again instead of leaving the client to time out.
+func dallyTFTP(conn *net.UDPConn, addr *net.UDPAddr, finalACK []byte, wait time.Duration) {
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if fromPeerTFTP(conn, addr, src) && n >= 4 && buf[1] == OPCODE_DATA && buf[2] == finalACK[2] && buf[3] == finalACK[3] {
+			_, _ = conn.WriteToUDP(finalACK, addr)
+		}
+	}
+}
+
+// negotiateTFTP applies the server's limits to the options a client requested and
+// returns the resulting transfer parameters plus the name/value pairs to send in an OACK.
+func (s *Server) negotiateTFTP(requested map[string]string) (TransferOptionsTFTP, []string) {
+	opts := TransferOptionsTFTP{
+		BlockSize:  BLOCK_SIZE,
+		Timeout:    s.Options.RetransmitTimeoutTFTP,
+		MaxRetries: s.Options.MaxRetriesTFTP,
+		Backoff:    s.Options.BackoffTFTP,
+		Rollover:   s.Options.RolloverTFTP,
+	}.withDefaults()
+	var oack []string
+
+	if raw, ok := requested[tftpOptionBlockSize]; ok {
+		if size, err := strconv.Atoi(raw); err == nil && size >= MIN_BLOCK_SIZE {
+			maxSize := s.Options.MaxBlockSizeTFTP
+			if maxSize <= 0 || maxSize > MAX_BLOCK_SIZE {
+				maxSize = MAX_BLOCK_SIZE
+			}
+			if size > maxSize {
+				size = maxSize
+			}
+			opts.BlockSize = size
+			oack = append(oack, tftpOptionBlockSize, strconv.Itoa(size))
+		}
+	}
+
+	if raw, ok := requested[tftpOptionWindowSize]; ok {
+		if size, err := strconv.Atoi(raw); err == nil && size >= 1 && size <= MAX_WINDOW_SIZE {
+			maxSize := s.Options.MaxWindowSizeTFTP
+			if maxSize <= 0 || maxSize > MAX_WINDOW_SIZE {
+				maxSize = MAX_WINDOW_SIZE
+			}
+			if size > maxSize {
+				size = maxSize
+			}
+			opts.WindowSize = size
+			oack = append(oack, tftpOptionWindowSize, strconv.Itoa(size))
+		}
+	}
+
+	// rollover is a de-facto extension (tftp-hpa and others) choosing the block number
+	// that follows 65535.
+	if raw, ok := requested[tftpOptionRollover]; ok {
+		switch raw {
+		case "0":
+			opts.Rollover = RolloverToZero
+			oack = append(oack, tftpOptionRollover, raw)
+		case "1":
+			opts.Rollover = RolloverToOne
+			oack = append(oack, tftpOptionRollover, raw)
+		}
+	}
+
+	if raw, ok := requested[tftpOptionTimeout]; ok {
+		if secs, err := strconv.Atoi(raw); err == nil && secs >= 1 && secs <= 255 {
+			opts.Timeout = time.Duration(secs) * time.Second
+			oack = append(oack, tftpOptionTimeout, strconv.Itoa(secs))
+		}
+	}
+
+	return opts, oack
+}
+
+func (o TransferOptionsTFTP) withDefaults() TransferOptionsTFTP {
+	if o.BlockSize <= 0 {
+		o.BlockSize = BLOCK_SIZE
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DEFAULT_TIMEOUT
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = DEFAULT_MAX_RETRIES
+	}
+	if o.WindowSize <= 0 {
+		o.WindowSize = 1
 	}
+	return o
 }
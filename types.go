@@ -1,25 +1,78 @@
 package tftp
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
 )
 
 type (
 	GetType uint8
 
+	// RolloverMode selects the block number that follows 65535 in long TFTP transfers.
+	RolloverMode uint8
+
+	// BootPlacement selects where a DHCP reply carries the boot file and TFTP server name.
+	BootPlacement uint8
+
 	Options struct {
 		ListenAddrTFTP, ListenAddrHTTP string
 		Getter                         Getter
 
+		// ExposeErrors echoes getter/putter error text to clients; by default they only see
+		// a generic message for the mapped TFTP error code or HTTP status.
+		ExposeErrors bool
+
+		// MaxBlockSizeTFTP caps the blksize a client may negotiate (0 = MAX_BLOCK_SIZE).
+		MaxBlockSizeTFTP int
+		// MaxWindowSizeTFTP caps the RFC 7440 windowsize a client may negotiate (0 = MAX_WINDOW_SIZE).
+		MaxWindowSizeTFTP int
+		// RetransmitTimeoutTFTP is the default retransmit interval (0 = DEFAULT_TIMEOUT);
+		// clients may override it with the timeout option.
+		RetransmitTimeoutTFTP time.Duration
+		// MaxRetriesTFTP aborts a transfer after this many unanswered retransmits (0 = DEFAULT_MAX_RETRIES).
+		MaxRetriesTFTP int
+		// BackoffTFTP doubles the retransmit interval after each timeout, up to MAX_RETRANSMIT_INTERVAL.
+		BackoffTFTP bool
+		// RolloverTFTP is the default block number rollover; clients may override it with
+		// the rollover option.
+		RolloverTFTP RolloverMode
+
+		// Putter receives TFTP uploads (WRQ); nil rejects write requests.
+		Putter Putter
+		// MaxWriteSizeTFTP caps the size of a single upload in bytes (0 = unlimited).
+		MaxWriteSizeTFTP int64
+
 		ListenAddrDHCP string
 		DHCPAllocator  DHCPAllocator
-		DHCPServerIP   net.IP
+		// DHCPLeaseStore persists ACKed leases across restarts (nil = allocator memory only).
+		DHCPLeaseStore  DHCPLeaseStore
+		DHCPServerIP    net.IP
 		AllowedDHCPMACs []string
+
+		// ProxyDHCP answers only PXE clients, with boot information and no address, so an
+		// existing DHCP server keeps assigning addresses.
+		ProxyDHCP bool
+		// ListenAddrPXE enables the PXE boot server discovery listener (usually ":4011").
+		ListenAddrPXE string
+
+		// ListenAddrDHCPv6 and DHCPv6Allocator enable the DHCPv6 server (usually "[::]:547").
+		// AllowedDHCPMACs applies to it too, matching the MAC relays or DUIDs carry.
+		ListenAddrDHCPv6 string
+		DHCPv6Allocator  DHCPv6Allocator
+		// DHCPv6ServerID is the server DUID (nil = derived from an interface MAC).
+		DHCPv6ServerID dhcpv6.DUID
+		// DHCPv6RapidCommit lets clients that ask for it skip Advertise/Request (RFC 8415 §18.3.1).
+		DHCPv6RapidCommit bool
 	}
 
 	Server struct {
@@ -29,12 +82,20 @@ type (
 		getter   Getter
 		getterMu sync.RWMutex
 
+		putter   Putter
+		putterMu sync.RWMutex
+
 		ctx    context.Context
 		cancel context.CancelFunc
 
 		httpServer *http.Server
 		tftpConn   *net.UDPConn
 		dhcpServer *server4.Server
+		pxeServer  *server4.Server
+
+		dhcpv6Server   *server6.Server
+		dhcpv6DUID     dhcpv6.DUID
+		dhcpv6DUIDOnce sync.Once
 
 		dhcpMACMu       sync.RWMutex
 		dhcpAllowedMACs map[string]struct{}
@@ -51,11 +112,76 @@ type (
 		GetType  GetType
 		Filename string
 		From     *Requestor
+
+		// Transfer carries the negotiated TFTP parameters (nil for HTTP).
+		Transfer *TransferOptionsTFTP
+
+		ctx context.Context
+	}
+
+	// TransferOptionsTFTP holds the per-transfer parameters negotiated with a TFTP client.
+	TransferOptionsTFTP struct {
+		// Mode is the lower-cased transfer mode, MODE_OCTET or MODE_NETASCII. Netascii
+		// content is translated on the wire; getters and putters see local line endings.
+		Mode string
+
+		BlockSize int
+
+		// TransferSize is the file size reported via tsize (0 when not negotiated).
+		TransferSize int64
+
+		Timeout    time.Duration
+		MaxRetries int
+		Backoff    bool
+
+		// WindowSize is the number of blocks sent before waiting for an ACK (RFC 7440).
+		WindowSize int
+
+		// Rollover decides whether block 65535 is followed by 0 or 1.
+		Rollover RolloverMode
 	}
 
 	Getter interface {
 		Get(getType GetType, ctx *Context) ([]byte, error)
 	}
+
+	// Artifact is content served to a client as a stream rather than a []byte, so large
+	// images are never held in memory. Size is -1 when unknown. Content is closed after
+	// the transfer if it implements io.Closer.
+	Artifact struct {
+		Content io.ReadSeeker
+		Size    int64
+		ModTime time.Time
+
+		// ETag is sent verbatim (including quotes) over HTTP. When empty, one is derived
+		// from Size and ModTime if ModTime is set.
+		ETag string
+
+		// ContentType overrides HTTP content type detection (extension, then sniffing).
+		ContentType        string
+		CacheControl       string
+		ContentDisposition string
+		// Header holds any extra HTTP response headers; it is applied last.
+		Header http.Header
+	}
+
+	// StreamGetter is an optional Getter extension that returns content as an Artifact.
+	// Both the TFTP sender and the HTTP handler prefer it over Get when implemented.
+	StreamGetter interface {
+		GetStream(getType GetType, ctx *Context) (*Artifact, error)
+	}
+
+	// Putter receives a file uploaded by a client. ctx carries the filename, requestor and
+	// negotiated transfer options; reader yields the file contents as they arrive.
+	Putter interface {
+		Put(getType GetType, ctx *Context, reader io.Reader) error
+	}
+
+	// Sizer is an optional Getter extension that reports a file's size without
+	// fetching it, letting tsize probes be answered cheaply.
+	Sizer interface {
+		Size(getType GetType, ctx *Context) (int64, error)
+	}
 )
 
 type GetterFunc func(getType GetType, ctx *Context) ([]byte, error)
@@ -63,3 +189,69 @@ type GetterFunc func(getType GetType, ctx *Context) ([]byte, error)
 func (f GetterFunc) Get(getType GetType, ctx *Context) ([]byte, error) {
 	return f(getType, ctx)
 }
+
+// StreamGetterFunc adapts a function to both StreamGetter and Getter; Get reads the whole
+// stream for callers that still need a []byte.
+type StreamGetterFunc func(getType GetType, ctx *Context) (*Artifact, error)
+
+func (f StreamGetterFunc) GetStream(getType GetType, ctx *Context) (*Artifact, error) {
+	return f(getType, ctx)
+}
+
+func (f StreamGetterFunc) Get(getType GetType, ctx *Context) ([]byte, error) {
+	artifact, err := f(getType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if artifact == nil || artifact.Content == nil {
+		return []byte{}, nil
+	}
+	defer artifact.Close()
+	return io.ReadAll(artifact.Content)
+}
+
+// Context returns the request's context.Context: the HTTP request's context, or one that
+// is cancelled when a TFTP transfer ends or the server stops. Getters and putters doing
+// slow I/O should honor it. It is never nil.
+func (c *Context) Context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of c carrying ctx.
+func (c *Context) WithContext(ctx context.Context) *Context {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// NewArtifact wraps in-memory content as an Artifact.
+func NewArtifact(content []byte) *Artifact {
+	return &Artifact{Content: bytes.NewReader(content), Size: int64(len(content))}
+}
+
+func (a *Artifact) etag() string {
+	if a.ETag != "" {
+		return a.ETag
+	}
+	if a.ModTime.IsZero() || a.Size < 0 {
+		return ""
+	}
+	return fmt.Sprintf(`"%x-%x"`, a.Size, a.ModTime.UnixNano())
+}
+
+// Close releases the underlying content if it holds resources (e.g. an *os.File).
+func (a *Artifact) Close() error {
+	if closer, ok := a.Content.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type PutterFunc func(getType GetType, ctx *Context, reader io.Reader) error
+
+func (f PutterFunc) Put(getType GetType, ctx *Context, reader io.Reader) error {
+	return f(getType, ctx, reader)
+}